@@ -1,6 +1,6 @@
 module main
 
-go 1.21
+go 1.22.2
 
 require (
 	github.com/disintegration/imaging v1.6.2
@@ -12,10 +12,24 @@ require (
 
 require github.com/evanw/esbuild v0.19.6
 
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/yuin/goldmark v1.6.0
+	golang.org/x/sync v0.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/gen2brain/webp v0.5.2
+
+require (
+	github.com/ebitengine/purego v0.8.1 // indirect
+	github.com/tetratelabs/wazero v1.9.0 // indirect
+)
+
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/image v0.14.0 // indirect
+	golang.org/x/image v0.24.0 // indirect
 	golang.org/x/sys v0.14.0 // indirect
 )
@@ -1,6 +1,6 @@
+// @imports are resolved by esbuild before postcss runs, see src/bundler.go
 module.exports = {
   plugins: {
-    "postcss-import": {},
     "@tailwindcss/nesting": {},
     tailwindcss: {},
     // autoprefixer: {}, // this adds additional 100ms to build css on save
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A preprocessor turns the raw block data from Directus into the data passed to
+// the block template, e.g. to fetch extra data or reshape fields.
+type BlockPreprocessor func(ctx context.Context, block Block) (any, error)
+
+// A block type maps a Directus collection to the template that renders it
+type BlockType struct {
+	Collection string // Directus collection, e.g. block_hero
+	Template   string // template name, e.g. block_hero
+	Skeleton   string // skeleton loader template shown while a lazy block loads
+	Preprocess BlockPreprocessor
+}
+
+type BlockRegistry struct {
+	mu            sync.RWMutex
+	types         map[string]BlockType
+	preprocessors map[string]BlockPreprocessor
+}
+
+const blocksDir = "src/components/blocks"
+
+var blockRegistry = newBlockRegistry()
+
+func newBlockRegistry() *BlockRegistry {
+	return &BlockRegistry{
+		types:         make(map[string]BlockType),
+		preprocessors: make(map[string]BlockPreprocessor),
+	}
+}
+
+// Skeleton loaders shown in place of lazy blocks, keyed by block collection
+var blockSkeletons = map[string]string{
+	"block_card":        "card-placeholder",
+	"block_cards":       "card-placeholder",
+	"block_image":       "image-placeholder",
+	"block_list":        "list-placeholder",
+	"block_map":         "map-placeholder",
+	"block_testimonial": "testimonial-placeholder",
+	"block_text":        "text-placeholder",
+	"block_video":       "video-placeholder",
+	"block_widget":      "widget-placeholder",
+}
+
+// registerPreprocessor attaches a Go preprocessor to a block collection. It
+// survives re-discovery, so it can be registered before or after discover.
+func (br *BlockRegistry) registerPreprocessor(collection string, preprocess BlockPreprocessor) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	br.preprocessors[collection] = preprocess
+	if blockType, ok := br.types[collection]; ok {
+		blockType.Preprocess = preprocess
+		br.types[collection] = blockType
+	}
+}
+
+// discover registers a block type for every template in src/components/blocks.
+// The file hero.go.html renders the Directus collection block_hero and must
+// define the template "block_hero".
+func (br *BlockRegistry) discover() error {
+	entries, err := os.ReadDir(blocksDir)
+	if err != nil {
+		return err
+	}
+
+	types := make(map[string]BlockType)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".go.html") {
+			continue
+		}
+
+		collection := "block_" + strings.TrimSuffix(entry.Name(), ".go.html")
+		skeleton, ok := blockSkeletons[collection]
+		if !ok {
+			skeleton = "default-skeleton"
+		}
+
+		types[collection] = BlockType{
+			Collection: collection,
+			Template:   collection,
+			Skeleton:   skeleton,
+		}
+	}
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	for collection, preprocess := range br.preprocessors {
+		if blockType, ok := types[collection]; ok {
+			blockType.Preprocess = preprocess
+			types[collection] = blockType
+		}
+	}
+	br.types = types
+
+	return nil
+}
+
+func (br *BlockRegistry) lookup(collection string) (BlockType, bool) {
+	br.mu.RLock()
+	defer br.mu.RUnlock()
+
+	blockType, ok := br.types[collection]
+	return blockType, ok
+}
+
+// renderBlock renders a single block with the template set of the page. Lazy
+// blocks render their skeleton loader and are fetched with htmx once revealed,
+// unless allowLazy is false (when rendering the block fragment itself).
+func (br *BlockRegistry) renderBlock(ctx context.Context, tmpl *template.Template, block Block, allowLazy bool) (template.HTML, error) {
+	blockType, ok := br.lookup(block.Collection)
+	if !ok || tmpl.Lookup(blockType.Template) == nil {
+		return missingBlock(block, fmt.Errorf("no template for block %q, add %s", block.Collection, blockTemplatePath(block.Collection)))
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if allowLazy && block.Lazy {
+		fmt.Fprintf(buf, `<div hx-get="%s/%d/%d" hx-trigger="revealed" hx-swap="outerHTML">`, BlockBaseRoute, block.PageID, block.ID)
+		if err := tmpl.ExecuteTemplate(buf, blockType.Skeleton, nil); err != nil {
+			return missingBlock(block, fmt.Errorf("rendering the skeleton of block %q: %w", block.Collection, err))
+		}
+		buf.WriteString(`</div>`)
+		return template.HTML(buf.String()), nil
+	}
+
+	var data any = block.Data
+	if blockType.Preprocess != nil {
+		var err error
+		data, err = blockType.Preprocess(ctx, block)
+		if err != nil {
+			return missingBlock(block, fmt.Errorf("preprocessing block %q: %w", block.Collection, err))
+		}
+	}
+
+	// a block with unexpected data skips that block instead of failing the page
+	if err := tmpl.ExecuteTemplate(buf, blockType.Template, data); err != nil {
+		return missingBlock(block, fmt.Errorf("rendering block %q: %w", block.Collection, err))
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// Blocks that can't be rendered are skipped in production, and shown as a
+// visible warning in development so they don't go unnoticed.
+func missingBlock(block Block, err error) (template.HTML, error) {
+	log.Printf("Skipping block %d: %v", block.ID, err)
+	if !config.isDevelopment() {
+		return "", nil
+	}
+
+	return template.HTML(fmt.Sprintf(
+		`<div class="edges-sm mx-auto my-5 max-w-7xl rounded border border-dashed border-yellow-500 p-4 font-mono text-sm text-yellow-500">⚠️ %s</div>`,
+		template.HTMLEscapeString(err.Error()),
+	)), nil
+}
+
+func blockTemplatePath(collection string) string {
+	return filepath.Join(blocksDir, strings.TrimPrefix(collection, "block_")+".go.html")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+// A block whose data doesn't fit its template is skipped in production and
+// shown as a warning in development, the rest of the page still renders
+func TestRenderBlockWithUnexpectedData(t *testing.T) {
+	registry := newBlockRegistry()
+	registry.types["block_broken"] = BlockType{Collection: "block_broken", Template: "block_broken"}
+	tmpl := template.Must(template.New("").Funcs(templateFuncs(nil, nil, "")).Parse(
+		`{{ define "block_broken" }}<p>{{ .count.value }}</p>{{ end }}`,
+	))
+	block := Block{ID: 1, Collection: "block_broken", Data: map[string]interface{}{"count": 3}}
+
+	defer func(env string) { config.Env = env }(config.Env)
+	for env, want := range map[string]string{"production": "", "development": "rendering block"} {
+		config.Env = env
+		html, err := registry.renderBlock(context.Background(), tmpl, block, false)
+		if err != nil {
+			t.Fatalf("%s: %v", env, err)
+		}
+		if want == "" && html != "" || !strings.Contains(string(html), want) {
+			t.Errorf("%s: rendered %q, want %q", env, html, want)
+		}
+	}
+}
+
+func TestNoescapeOfMissingField(t *testing.T) {
+	tmpl := template.Must(template.New("").Funcs(templateFuncs(nil, nil, "")).Parse(`<div>{{ .content | noescape }}</div>`))
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "<div></div>" {
+		t.Errorf("rendered %q", out.String())
+	}
+}
@@ -2,80 +2,248 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/evanw/esbuild/pkg/api"
 	"github.com/fatih/color"
 )
 
-func bundleAssets() {
+// Serializes builds, so the watcher and startup never bundle at the same time
+var buildMu sync.Mutex
+
+// bundleAssets builds the js bundles and main.css. Errors are logged and sent
+// to the browser where they happen. main.css is built even when the other
+// steps failed, so pages keep their styles.
+func bundleAssets() error {
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
 	start := time.Now()
 
 	// getGoogleFont("https://fonts.googleapis.com/css2?family=Inter&display=swap")
 
-	postCSS("src/styles/main.css", "tmp/postcss/bundled.css")
-
-	// esbuild -> bundles ts and any css that was imported in ts
-	result := api.Build(api.BuildOptions{
-		EntryPoints:       []string{"./src/templates/*.ts"},
-		Bundle:            true,
-		Outdir:            ".generated/esbuild/templates",
-		Write:             true,
-		Target:            api.ESNext,
-		MinifySyntax:      true,
-		MinifyWhitespace:  true,
-		MinifyIdentifiers: false,
-		Sourcemap:         api.SourceMapLinked,
-	})
-	if len(result.Errors) > 0 {
-		for _, err := range result.Errors {
-			bundlerLogger(color.RedString("Error bundleAssets:"))
-			os.Stderr.WriteString(err.Text)
+	stylesErr := buildStyles()
+	scriptsErr := buildScripts()
+	if err := errors.Join(stylesErr, scriptsErr, buildCSS()); err != nil {
+		return err
+	}
+
+	bundlerLogger(fmt.Sprintf("assets bundled in %0.2fms", time.Since(start).Seconds()*1000))
+	return nil
+}
+
+const (
+	stylesEntry    = "src/styles/main.css"
+	stylesBundled  = "tmp/styles/bundled.css"  // the styles with their @imports resolved
+	stylesTailwind = "tmp/styles/tailwind.css" // the bundled styles after tailwind
+)
+
+// esbuild contexts live for the whole process, so rebuilds in development
+// only redo the work for the files that changed
+var (
+	scriptsContext api.BuildContext
+	scriptsEntries []api.EntryPoint
+	stylesContext  api.BuildContext
+	cssContext     api.BuildContext
+	cssEntry       string
+)
+
+// esbuild -> bundles ts and any css that was imported in ts, for the page
+// templates and the components. Code shared by several of them is split into
+// chunks.
+func buildScripts() error {
+	entries := []api.EntryPoint{}
+	templateScripts, _ := filepath.Glob("src/templates/*.ts")
+	for _, file := range templateScripts {
+		entries = append(entries, api.EntryPoint{InputPath: file, OutputPath: strings.TrimSuffix(filepath.Base(file), ".ts")})
+	}
+	entries = append(entries, componentEntries()...)
+
+	// a context has a fixed set of entry points, start over when a script was added or removed
+	if scriptsContext != nil && !slices.Equal(entries, scriptsEntries) {
+		scriptsContext.Dispose()
+		scriptsContext = nil
+	}
+
+	if scriptsContext == nil {
+		ctx, err := api.Context(api.BuildOptions{
+			EntryPointsAdvanced: entries,
+			Bundle:              true,
+			Outdir:              bundleDir,
+			EntryNames:          "[name]-[hash]",
+			Splitting:           true,
+			Format:              api.FormatESModule,
+			Metafile:            true,
+			Write:               true,
+			Target:              api.ESNext,
+			MinifySyntax:        true,
+			MinifyWhitespace:    true,
+			MinifyIdentifiers:   false,
+			Sourcemap:           api.SourceMapLinked,
+		})
+		if err != nil {
+			return reportMessages("bundleAssets", nil, err.Errors)
 		}
-		return
+		scriptsContext, scriptsEntries = ctx, entries
 	}
 
-	pruneOldFiles(result)
+	result := scriptsContext.Rebuild()
+	if err := reportMessages("bundleAssets", result.Warnings, result.Errors); err != nil {
+		return err
+	}
 
-	cmdStr := "cat ./tmp/postcss/bundled.css > ./tmp/bundled.css"
-	if fileExists(".generated/esbuild/templates/app.css") {
-		cmdStr = "cat .generated/esbuild/templates/app.css ./tmp/postcss/bundled.css > ./tmp/bundled.css"
+	current := []string{}
+	for _, file := range result.OutputFiles {
+		current = append(current, filepath.Base(file.Path))
 	}
-	// combine postcss and esbuild css with cat command
-	cmd := exec.Command("bash", "-c", cmdStr)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	cmdErr := cmd.Run()
-	if cmdErr != nil {
-		color.Red(fmt.Sprint(cmdErr) + ": " + stderr.String())
-		return
+	pruneOldFiles(bundleDir, bundleRoute, current)
+
+	files, imports, err := bundleManifest(result.Metafile)
+	if err == nil {
+		err = manifest.replace(bundleRoute, files, imports)
+	}
+	if err != nil {
+		bundlerLogger(color.RedString("Error writing the manifest: %s", err))
+		return err
 	}
+	return nil
+}
 
-	// minify the bundled css
-	result = api.Build(api.BuildOptions{
-		EntryPoints:       []string{"tmp/bundled.css"},
-		Bundle:            true,
-		Outfile:           ".generated/css/main.css",
-		Write:             true,
-		Target:            api.ES2015,
-		MinifySyntax:      true,
-		MinifyWhitespace:  true,
-		MinifyIdentifiers: true,
-	})
+// buildStyles resolves the @imports of the styles with esbuild and runs
+// tailwind over the result. Without tailwind there is nothing to do here,
+// buildCSS bundles the styles entry directly.
+func buildStyles() error {
+	if !config.Assets.Tailwind {
+		return nil
+	}
 
-	if len(result.Errors) > 0 {
-		bundlerLogger(color.RedString("Error esbuildCSS:"))
-		os.Stderr.WriteString(result.Errors[0].Text)
+	if stylesContext == nil {
+		ctx, err := api.Context(api.BuildOptions{
+			EntryPoints: []string{stylesEntry},
+			Bundle:      true,
+			Outfile:     stylesBundled,
+			Write:       true,
+		})
+		if err != nil {
+			return reportMessages("esbuildStyles", nil, err.Errors)
+		}
+		stylesContext = ctx
 	}
 
-	bundlerLogger(fmt.Sprintf("assets bundled in %0.2fms", time.Since(start).Seconds()*1000))
+	result := stylesContext.Rebuild()
+	if err := reportMessages("esbuildStyles", result.Warnings, result.Errors); err != nil {
+		return err
+	}
+
+	return postCSS(stylesBundled, stylesTailwind)
 }
 
-func postCSS(inputPath string, outputPath string) {
+// Combines the css imported in ts with the styles into the minified main.css
+func buildCSS() error {
+	imports := []string{stylesEntry}
+	if config.Assets.Tailwind {
+		if _, err := os.Stat(stylesTailwind); err == nil {
+			imports = []string{stylesTailwind}
+		} else {
+			// tailwind never ran, build the styles without its classes
+			bundlerLogger(color.YellowString("Warning esbuildCSS: %s is missing, building main.css without tailwind", stylesTailwind))
+		}
+	}
+	if url, found := manifest.lookup("app.css"); found {
+		imports = append([]string{assetPath(url)}, imports...)
+	}
+
+	entry := ""
+	for _, path := range imports {
+		entry += fmt.Sprintf("@import %q;\n", "./"+path)
+	}
+
+	// the entry is passed as stdin, which is fixed for the life of a context
+	if cssContext != nil && entry != cssEntry {
+		cssContext.Dispose()
+		cssContext = nil
+	}
+
+	if cssContext == nil {
+		ctx, err := api.Context(api.BuildOptions{
+			Stdin: &api.StdinOptions{
+				Contents:   entry,
+				ResolveDir: getCwd(),
+				Sourcefile: "main.css",
+				Loader:     api.LoaderCSS,
+			},
+			Bundle:            true,
+			Outfile:           filepath.Join(cssDir, "main.css"),
+			Write:             false,
+			Target:            api.ES2015,
+			MinifySyntax:      true,
+			MinifyWhitespace:  true,
+			MinifyIdentifiers: true,
+		})
+		if err != nil {
+			return reportMessages("esbuildCSS", nil, err.Errors)
+		}
+		cssContext, cssEntry = ctx, entry
+	}
+
+	result := cssContext.Rebuild()
+	if err := reportMessages("esbuildCSS", result.Warnings, result.Errors); err != nil {
+		return err
+	}
+
+	// main-<hash>.css, written in one step so it's never served half-written
+	css := result.OutputFiles[0].Contents
+	name := "main-" + contentHash(css) + ".css"
+	if err := writeFileAtomic(filepath.Join(cssDir, name), css); err != nil {
+		bundlerLogger(color.RedString("Error writing %s: %s", name, err))
+		return err
+	}
+
+	pruneOldFiles(cssDir, cssRoute, []string{name})
+
+	if err := manifest.replace(cssRoute, map[string]string{"main.css": cssRoute + name}, nil); err != nil {
+		bundlerLogger(color.RedString("Error writing the manifest: %s", err))
+		return err
+	}
+	return nil
+}
+
+// Logs esbuild warnings and errors with their file:line location and sends
+// the errors to the browser. Returns an error when there were any errors.
+func reportMessages(step string, warnings []api.Message, errors []api.Message) error {
+	for _, msg := range warnings {
+		bundlerLogger(color.YellowString("Warning %s: %s", step, formatMessage(msg)))
+	}
+	for _, msg := range errors {
+		text := formatMessage(msg)
+		bundlerLogger(color.RedString("Error %s: %s", step, text))
+		liveReload.broadcast("builderror", text)
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s failed with %d error(s)", step, len(errors))
+	}
+	return nil
+}
+
+// src/templates/app.ts:3:19: Could not resolve "htmx.org"
+func formatMessage(msg api.Message) string {
+	if msg.Location == nil {
+		return msg.Text
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column+1, msg.Text)
+}
+
+// Runs postcss with postcss.config.js, which generates the tailwind classes.
+// A failed run fails the build, rather than carrying on with stale output.
+func postCSS(inputPath string, outputPath string) error {
 	cmd := exec.Command(
 		"./node_modules/.bin/postcss",
 		inputPath,
@@ -84,11 +252,13 @@ func postCSS(inputPath string, outputPath string) {
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	cmdErr := cmd.Run()
-	if cmdErr != nil {
-		color.Red(fmt.Sprint(cmdErr) + ": " + stderr.String())
-		return
+	if err := cmd.Run(); err != nil {
+		text := strings.TrimSpace(fmt.Sprint(err) + ": " + stderr.String())
+		bundlerLogger(color.RedString("Error postCSS: %s", text))
+		liveReload.broadcast("builderror", text)
+		return fmt.Errorf("postCSS: %w", err)
 	}
+	return nil
 }
 
 func getCwd() string {
@@ -101,36 +271,57 @@ func getCwd() string {
 	return cwd
 }
 
-// remove any files from .generated/esbuild/templates that were not generated by esbuild
-func pruneOldFiles(esbuildResult api.BuildResult) {
-	cwd := getCwd()
-	generatedFilePaths := []string{}
-	// log the esbuilt api.BuildResult
-	if len(esbuildResult.OutputFiles) > 0 {
-		for _, val := range esbuildResult.OutputFiles {
-			generatedFilePaths = append(generatedFilePaths, val.Path)
-			// bundlerLogger(fmt.Sprintf("esbuild: %s", val.Path))
+// pruneOldFiles removes the files in dir that aren't part of the current
+// build, once no cached page can load them anymore. The files of the build
+// before, still in the manifest, are stamped with the time they were replaced
+// and kept for retainedAssetAge.
+func pruneOldFiles(dir string, route string, current []string) {
+	previous := manifest.filesIn(route)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		bundlerLogger(color.RedString("Error reading %s: %s", dir, err))
+		return
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-retainedAssetAge())
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || slices.Contains(current, name) {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		if previous[strings.TrimSuffix(name, ".map")] {
+			os.Chtimes(path, now, now)
+			continue
+		}
+		if info, err := entry.Info(); err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			bundlerLogger(color.RedString("Error removing %s: %s", path, err))
 		}
 	}
+}
 
-	fileInfos, err := os.ReadDir(".generated/esbuild/templates")
-	if err != nil {
-		// bundlerLogger(color.RedString("Error reading directory:"))
-		os.Stderr.WriteString(err.Error())
-		return
+// Pages are served from caches for up to their max-age plus
+// stale-while-revalidate, and load the bundles of the build they were
+// rendered with until then. Outside production pages aren't cached.
+func retainedAssetAge() time.Duration {
+	if config.Env != "production" {
+		return 0
+	}
+
+	longest := 0
+	policies := []CachePolicy{config.HTTPCache.Default}
+	for _, policy := range config.HTTPCache.Templates {
+		policies = append(policies, policy)
 	}
-	for _, fileInfo := range fileInfos {
-		filePath := cwd + "/.generated/esbuild/templates/" + fileInfo.Name()
-
-		if !slices.Contains(generatedFilePaths, filePath) {
-			err := os.Remove(filePath)
-			if err != nil {
-				bundlerLogger(color.RedString("Error removing file:"))
-				os.Stderr.WriteString(err.Error())
-				return
-			}
-			// bundlerLogger(fmt.Sprintf("removed file: %s", filePath))
+	for _, policy := range policies {
+		if !policy.NoStore {
+			longest = max(longest, policy.MaxAge+policy.StaleWhileRevalidate)
 		}
-		// bundlerLogger(fmt.Sprintf("current existing files: %s", filePath))
 	}
+	return time.Duration(longest) * time.Second
 }
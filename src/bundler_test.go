@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Cached pages keep loading the bundles of the build they were rendered with
+func TestPruneOldFilesKeepsCachedBundles(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func(m *assetManifest, env string) { manifest, config.Env = m, env }(manifest, config.Env)
+	manifest = &assetManifest{files: make(map[string]string), imports: make(map[string][]string)}
+	config.Env = "production"
+
+	os.MkdirAll(bundleDir, 0o755)
+	longAgo := time.Now().Add(-retainedAssetAge() - time.Hour)
+	for _, name := range []string{"app-NEW.js", "app-PREVIOUS.js", "app-PREVIOUS.js.map", "chunk-PREVIOUS.js", "app-RETIRED.js", "app-OLD.js"} {
+		path := filepath.Join(bundleDir, name)
+		os.WriteFile(path, nil, 0o644)
+		os.Chtimes(path, longAgo, longAgo)
+	}
+	// replaced by the previous build a moment ago
+	os.Chtimes(filepath.Join(bundleDir, "app-RETIRED.js"), time.Now(), time.Now())
+
+	manifest.replace(bundleRoute, map[string]string{"app.js": bundleRoute + "app-PREVIOUS.js"}, map[string][]string{"app.js": {bundleRoute + "chunk-PREVIOUS.js"}})
+	pruneOldFiles(bundleDir, bundleRoute, []string{"app-NEW.js"})
+
+	for name, kept := range map[string]bool{
+		"app-NEW.js":          true,
+		"app-PREVIOUS.js":     true,
+		"app-PREVIOUS.js.map": true,
+		"chunk-PREVIOUS.js":   true,
+		"app-RETIRED.js":      true,
+		"app-OLD.js":          false,
+	} {
+		if _, err := os.Stat(filepath.Join(bundleDir, name)); (err == nil) != kept {
+			t.Errorf("%s kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+
+	// the previous build was stamped with the time it was replaced
+	if info, _ := os.Stat(filepath.Join(bundleDir, "app-PREVIOUS.js")); time.Since(info.ModTime()) > time.Minute {
+		t.Errorf("app-PREVIOUS.js modified at %s, want now", info.ModTime())
+	}
+}
+
+func TestRetainedAssetAge(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config.Env = "production"
+	config.HTTPCache = defaultHTTPCacheConfig()
+	config.HTTPCache.Templates["contact"] = CachePolicy{MaxAge: 3600, StaleWhileRevalidate: 86400}
+	config.HTTPCache.Templates["account"] = CachePolicy{NoStore: true, MaxAge: 999999}
+
+	if got, want := retainedAssetAge(), (3600+86400)*time.Second; got != want {
+		t.Errorf("retainedAssetAge = %s, want %s", got, want)
+	}
+
+	config.Env = "development"
+	if got := retainedAssetAge(); got != 0 {
+		t.Errorf("retainedAssetAge in development = %s, want 0", got)
+	}
+}
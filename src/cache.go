@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type PageCacheConfig struct {
+	TTL         time.Duration `toml:"ttl" yaml:"ttl"`                     // pages are fresh for this long
+	MaxStale    time.Duration `toml:"max_stale" yaml:"max_stale"`         // after TTL, stale pages are served while refreshing for up to this long
+	NotFoundTTL time.Duration `toml:"not_found_ttl" yaml:"not_found_ttl"` // how long a not found lookup is remembered
+	MaxEntries  int           `toml:"max_entries" yaml:"max_entries"`     // least recently used pages are evicted above this size
+}
+
+var defaultPageCacheConfig = PageCacheConfig{
+	TTL:         10 * time.Second,
+	MaxStale:    10 * time.Minute,
+	NotFoundTTL: 5 * time.Second,
+	MaxEntries:  1000,
+}
+
+type pageCacheEntry struct {
+	key        string
+	page       Page
+	notFound   bool
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// PageCache is a bounded stale-while-revalidate cache of page data keyed by url.
+// Concurrent misses for the same url share a single load, and not found pages
+// are cached for a short time so random urls don't all hit the database.
+type PageCache struct {
+	mu      sync.Mutex
+	config  PageCacheConfig
+	entries map[string]*list.Element
+	lru     *list.List
+	deps    map[string]map[string]bool // dependency key -> cache keys of the pages using it
+	group   singleflight.Group
+	load    func(key string) (Page, error)
+
+	// bumped by every invalidation, loads that started before one are not
+	// stored since they may have read the old data
+	generation uint64
+}
+
+var pageCache = newPageCache(defaultPageCacheConfig, loadPage)
+
+func newPageCache(config PageCacheConfig, load func(key string) (Page, error)) *PageCache {
+	return &PageCache{
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		deps:    make(map[string]map[string]bool),
+		load:    load,
+	}
+}
+
+func (c *PageCache) get(key string) (Page, error) {
+	c.mu.Lock()
+	element, found := c.entries[key]
+	if found {
+		entry := element.Value.(*pageCacheEntry)
+		age := time.Since(entry.fetchedAt)
+		c.lru.MoveToFront(element)
+
+		switch {
+		case entry.notFound && age < c.config.NotFoundTTL:
+			c.mu.Unlock()
+			return Page{}, errPageNotFound
+
+		case entry.notFound:
+			// expired not found entry, look it up again below
+
+		case age < c.config.TTL:
+			c.mu.Unlock()
+			return entry.page, nil
+
+		case age < c.config.TTL+c.config.MaxStale:
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(key)
+			}
+			c.mu.Unlock()
+			return entry.page, nil
+		}
+	}
+	c.mu.Unlock()
+
+	return c.fetch(key)
+}
+
+// fetch loads the page, sharing the result between concurrent callers for the same key
+func (c *PageCache) fetch(key string) (Page, error) {
+	result, err, _ := c.group.Do(key, func() (interface{}, error) {
+		c.mu.Lock()
+		generation := c.generation
+		c.mu.Unlock()
+
+		page, err := c.load(key)
+		if errors.Is(err, errPageNotFound) {
+			c.store(key, Page{}, true, generation)
+			return Page{}, err
+		}
+		if err != nil {
+			return Page{}, err
+		}
+		return c.store(key, page, false, generation), nil
+	})
+	return result.(Page), err
+}
+
+func (c *PageCache) refresh(key string) {
+	_, err := c.fetch(key)
+	if err != nil && !errors.Is(err, errPageNotFound) {
+		fmt.Printf("Error refreshing page data for %s: %v\n", key, err)
+
+		// keep serving the stale page, the next request will retry
+		c.mu.Lock()
+		if element, found := c.entries[key]; found {
+			element.Value.(*pageCacheEntry).refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// store caches a loaded page, unless the cache was invalidated while it was
+// loading. The page is returned to the callers either way.
+func (c *PageCache) store(key string, page Page, notFound bool, generation uint64) Page {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	page.CachedAt = time.Now()
+	if generation != c.generation {
+		// a stale entry that was being refreshed is refreshed again on the next request
+		if element, found := c.entries[key]; found {
+			element.Value.(*pageCacheEntry).refreshing = false
+		}
+		return page
+	}
+
+	entry := &pageCacheEntry{
+		key:       key,
+		page:      page,
+		notFound:  notFound,
+		fetchedAt: page.CachedAt,
+	}
+
+	if element, found := c.entries[key]; found {
+		c.unindex(element.Value.(*pageCacheEntry))
+		element.Value = entry
+		c.lru.MoveToFront(element)
+	} else {
+		c.entries[key] = c.lru.PushFront(entry)
+	}
+	c.index(entry)
+
+	for c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+
+	return page
+}
+
+// remove drops an entry from the cache, the caller must hold the lock
+func (c *PageCache) remove(element *list.Element) {
+	entry := element.Value.(*pageCacheEntry)
+	c.unindex(entry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+}
+
+func (c *PageCache) index(entry *pageCacheEntry) {
+	if entry.notFound {
+		return
+	}
+	for _, dep := range entry.page.dependencies() {
+		if c.deps[dep] == nil {
+			c.deps[dep] = make(map[string]bool)
+		}
+		c.deps[dep][entry.key] = true
+	}
+}
+
+func (c *PageCache) unindex(entry *pageCacheEntry) {
+	if entry.notFound {
+		return
+	}
+	for _, dep := range entry.page.dependencies() {
+		delete(c.deps[dep], entry.key)
+		if len(c.deps[dep]) == 0 {
+			delete(c.deps, dep)
+		}
+	}
+}
+
+// invalidate evicts every page that depends on one of the given keys and
+// returns their cache keys
+func (c *PageCache) invalidate(deps ...string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	keys := []string{}
+	for _, dep := range deps {
+		for key := range c.deps[dep] {
+			if element, found := c.entries[key]; found {
+				c.remove(element)
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// purge empties the whole cache
+func (c *PageCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.deps = make(map[string]map[string]bool)
+}
+
+// invalidateNotFound evicts all cached not found lookups, e.g. when a page is
+// created or published and might now exist at one of those urls
+func (c *PageCache) invalidateNotFound() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, element := range c.entries {
+		if element.Value.(*pageCacheEntry).notFound {
+			c.remove(element)
+		}
+	}
+}
+
+// findByID returns a cached page that is still usable, without loading it.
+// Pages depend on their own page item, so the dependency index finds them.
+// Pages that relate to it depend on it too, so the id is checked.
+func (c *PageCache) findByID(pageID int) (Page, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.deps[dependencyKey("page", pageID)] {
+		element, found := c.entries[key]
+		if !found {
+			continue
+		}
+		entry := element.Value.(*pageCacheEntry)
+		if !entry.notFound && entry.page.ID == pageID && time.Since(entry.fetchedAt) < c.config.TTL+c.config.MaxStale {
+			return entry.page, true
+		}
+	}
+	return Page{}, false
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLoader loads a page per key and counts the loads
+type countingLoader struct {
+	loads atomic.Int32
+	// set to make loads wait until it's closed
+	wait chan struct{}
+	err  error
+}
+
+func (l *countingLoader) load(key string) (Page, error) {
+	l.loads.Add(1)
+	if l.wait != nil {
+		<-l.wait
+	}
+	if l.err != nil {
+		return Page{}, l.err
+	}
+	return Page{ID: 1, Title: key}, nil
+}
+
+func testPageCacheConfig() PageCacheConfig {
+	return PageCacheConfig{TTL: time.Hour, MaxStale: time.Hour, NotFoundTTL: time.Hour, MaxEntries: 10}
+}
+
+func TestPageCacheHit(t *testing.T) {
+	loader := &countingLoader{}
+	cache := newPageCache(testPageCacheConfig(), loader.load)
+
+	for i := 0; i < 3; i++ {
+		page, err := cache.get("/a")
+		if err != nil || page.Title != "/a" {
+			t.Fatalf("get = %+v, %v", page, err)
+		}
+	}
+	if n := loader.loads.Load(); n != 1 {
+		t.Errorf("loads = %d, want 1", n)
+	}
+}
+
+func TestPageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	config := testPageCacheConfig()
+	config.MaxEntries = 2
+	loader := &countingLoader{}
+	cache := newPageCache(config, loader.load)
+
+	cache.get("/a")
+	cache.get("/b")
+	cache.get("/a") // /b is now the least recently used
+	cache.get("/c")
+
+	if _, found := cache.entries["/b"]; found {
+		t.Error("/b should have been evicted")
+	}
+	for _, key := range []string{"/a", "/c"} {
+		if _, found := cache.entries[key]; !found {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+	if cache.deps[dependencyKey("page", 1)]["/b"] {
+		t.Error("evicted pages should be removed from the dependency index")
+	}
+}
+
+func TestPageCacheRemembersNotFound(t *testing.T) {
+	config := testPageCacheConfig()
+	config.NotFoundTTL = 20 * time.Millisecond
+	loader := &countingLoader{err: errPageNotFound}
+	cache := newPageCache(config, loader.load)
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.get("/missing"); err != errPageNotFound {
+			t.Fatalf("get error = %v, want errPageNotFound", err)
+		}
+	}
+	if n := loader.loads.Load(); n != 1 {
+		t.Errorf("loads = %d, want 1", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	cache.get("/missing")
+	if n := loader.loads.Load(); n != 2 {
+		t.Errorf("loads after the not found ttl = %d, want 2", n)
+	}
+}
+
+func TestPageCacheServesStaleWhileRefreshing(t *testing.T) {
+	config := testPageCacheConfig()
+	config.TTL = 10 * time.Millisecond
+	loader := &countingLoader{}
+	cache := newPageCache(config, loader.load)
+
+	first, _ := cache.get("/a")
+	time.Sleep(20 * time.Millisecond)
+
+	loader.wait = make(chan struct{})
+	stale, err := cache.get("/a")
+	if err != nil || !stale.CachedAt.Equal(first.CachedAt) {
+		t.Fatalf("get = %+v, %v, want the stale page", stale, err)
+	}
+	// a second request doesn't start another refresh
+	cache.get("/a")
+	close(loader.wait)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		cache.mu.Lock()
+		refreshed := cache.entries["/a"].Value.(*pageCacheEntry).page.CachedAt.After(first.CachedAt)
+		cache.mu.Unlock()
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stale page was not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := loader.loads.Load(); n != 2 {
+		t.Errorf("loads = %d, want 2", n)
+	}
+}
+
+func TestPageCacheCollapsesConcurrentMisses(t *testing.T) {
+	loader := &countingLoader{wait: make(chan struct{})}
+	cache := newPageCache(testPageCacheConfig(), loader.load)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.get("/a"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// give the goroutines time to join the load before it finishes
+	time.Sleep(20 * time.Millisecond)
+	close(loader.wait)
+	wg.Wait()
+
+	if n := loader.loads.Load(); n != 1 {
+		t.Errorf("loads = %d, want 1", n)
+	}
+}
+
+func TestPageCacheInvalidate(t *testing.T) {
+	loader := &countingLoader{}
+	cache := newPageCache(testPageCacheConfig(), loader.load)
+
+	cache.get("/a")
+	keys := cache.invalidate(dependencyKey("page", 1))
+	if len(keys) != 1 || keys[0] != "/a" {
+		t.Fatalf("invalidated = %v, want [/a]", keys)
+	}
+
+	cache.get("/a")
+	if n := loader.loads.Load(); n != 2 {
+		t.Errorf("loads = %d, want 2", n)
+	}
+}
+
+func TestPageCacheDropsLoadsStartedBeforeInvalidation(t *testing.T) {
+	for name, invalidate := range map[string]func(*PageCache){
+		"invalidate": func(c *PageCache) { c.invalidate(dependencyKey("page", 1)) },
+		"purge":      func(c *PageCache) { c.purge() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			loader := &countingLoader{wait: make(chan struct{})}
+			cache := newPageCache(testPageCacheConfig(), loader.load)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				cache.get("/a")
+			}()
+			for loader.loads.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			invalidate(cache)
+			close(loader.wait)
+			<-done
+
+			if _, found := cache.entries["/a"]; found {
+				t.Fatal("a page loaded before the invalidation was cached")
+			}
+			cache.get("/a")
+			if n := loader.loads.Load(); n != 2 {
+				t.Errorf("loads = %d, want 2", n)
+			}
+		})
+	}
+}
+
+// Pages are found by id through the dependency index, a page that relates
+// to another page isn't mistaken for it
+func TestPageCacheFindByID(t *testing.T) {
+	pages := map[string]Page{
+		"/a": {ID: 1, Blocks: []Block{{ID: 10, Collection: "block_links", Item: "1", Dependencies: []string{dependencyKey("page", 2)}}}},
+		"/b": {ID: 2},
+	}
+	cache := newPageCache(testPageCacheConfig(), func(key string) (Page, error) { return pages[key], nil })
+
+	cache.get("/a")
+	if page, found := cache.findByID(2); found {
+		t.Fatalf("findByID(2) = page %d before /b was cached", page.ID)
+	}
+	cache.get("/b")
+	if page, found := cache.findByID(2); !found || page.ID != 2 {
+		t.Errorf("findByID(2) = page %d, %v", page.ID, found)
+	}
+	if page, found := cache.findByID(1); !found || page.ID != 1 {
+		t.Errorf("findByID(1) = page %d, %v", page.ID, found)
+	}
+
+	cache.invalidate(dependencyKey("page", 2))
+	if _, found := cache.findByID(2); found {
+		t.Error("findByID(2) found an invalidated page")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "start the server (default)", serveCommand},
+	{"dev", "start the server with the file watcher and live reload", devCommand},
+	{"build-assets", "bundle the css and ts once", buildAssetsCommand},
+	{"export", "render the site to static files", exportCommand},
+	{"images", "manage optimized images, `images prune` deletes them", imagesCommand},
+	{"routes", "list the routes and published pages", routesCommand},
+	{"check-templates", "parse every template and report errors", checkTemplatesCommand},
+	{"config", "print the loaded config with secrets redacted", configCommand},
+}
+
+// runCLI runs the subcommand in args, serve when there is none
+func runCLI(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		return nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err := cmd.run(args)
+			if errors.Is(err, flag.ErrHelp) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: main <command> [flags]\n\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nRun main <command> --help for the flags of a command.")
+}
+
+// Flags shared by the commands. Unset flags fall back to the config file and
+// environment (PORT, APP_ENV), then to the defaults of the command.
+type options struct {
+	port         int
+	env          string
+	config       string
+	noLiveReload bool
+}
+
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.IntVar(&opts.port, "port", 0, "port to listen on (env PORT, default 42069)")
+	flags.StringVar(&opts.env, "env", "", "environment, development or production (env APP_ENV)")
+	flags.StringVar(&opts.config, "config", "", "config file, cookie.toml or cookie.yaml by default. Other files are loaded as env files instead of .env")
+	return flags
+}
+
+// Load the config, apply the flags on top and validate the result.
+// withContent also validates the content source settings.
+func (opts options) apply(defaultEnv string, withContent bool) error {
+	c, err := loadConfig(defaultEnv, opts.config)
+	if err != nil {
+		return err
+	}
+
+	if opts.port != 0 {
+		c.Port = opts.port
+	}
+	if opts.env != "" {
+		c.Env = opts.env
+	}
+	if opts.noLiveReload {
+		c.LiveReload = false
+	}
+
+	if err := c.validate(withContent); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	config = c
+	return nil
+}
+
+func serveCommand(args []string) error {
+	var opts options
+	if err := newFlagSet("serve", &opts).Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("production", true); err != nil {
+		return err
+	}
+
+	banner()
+	// assets from an earlier build-assets keep being served if bundling fails
+	prebuilt := loadManifest()
+	if err := bundleAssets(); err != nil {
+		if !prebuilt {
+			return err
+		}
+		serverLogger(color.YellowString("serving the assets of the last build, bundling failed: %s", err))
+	}
+	server()
+	return nil
+}
+
+func devCommand(args []string) error {
+	var opts options
+	flags := newFlagSet("dev", &opts)
+	flags.BoolVar(&opts.noLiveReload, "no-livereload", false, "don't reload browsers on file changes (env LIVE_RELOAD=false)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("development", true); err != nil {
+		return err
+	}
+
+	banner()
+	go watcher()
+
+	// the server starts anyway, with the assets of the last build, and the
+	// watcher rebuilds once the error is fixed
+	loadManifest()
+	_ = bundleAssets()
+	server()
+	return nil
+}
+
+func buildAssetsCommand(args []string) error {
+	var opts options
+	if err := newFlagSet("build-assets", &opts).Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("production", false); err != nil {
+		return err
+	}
+
+	return bundleAssets()
+}
+
+func exportCommand(args []string) error {
+	var opts options
+	flags := newFlagSet("export", &opts)
+	out := flags.String("out", "dist", "directory to export to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("production", true); err != nil {
+		return err
+	}
+
+	dir := *out
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+	return exportSite(dir)
+}
+
+func imagesCommand(args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return errors.New("usage: main images prune [--older-than 720h]")
+	}
+
+	var opts options
+	flags := newFlagSet("images prune", &opts)
+	olderThan := flags.Duration("older-than", 0, "only delete images not modified for this long")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := opts.apply("production", false); err != nil {
+		return err
+	}
+
+	removed, err := pruneImages(".generated/images", *olderThan)
+	if err != nil {
+		return err
+	}
+	serverLogger(fmt.Sprintf("pruned %d optimized images", removed))
+	return nil
+}
+
+// Delete optimized images older than maxAge, all of them when it's 0
+func pruneImages(dir string, maxAge time.Duration) (int, error) {
+	removed := 0
+	cutoff := time.Now().Add(-maxAge)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if maxAge > 0 && info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		removed++
+		return os.Remove(path)
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	// clean up the directories of images that are now empty
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return removed, nil
+}
+
+func routesCommand(args []string) error {
+	var opts options
+	if err := newFlagSet("routes", &opts).Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("production", true); err != nil {
+		return err
+	}
+
+	if err := initContentSource(); err != nil {
+		return err
+	}
+	pages, err := content.ListPages(context.Background())
+	if err != nil {
+		return err
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pageURI(pages[i]) < pageURI(pages[j])
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tTEMPLATE\tTITLE")
+	for _, page := range pages {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", pageURI(page), getTemplateName(page.Template), page.Title)
+	}
+	for _, route := range []string{
+		"/css/", "/bundle/", "/static/", "/robots.txt", "/favicon.ico",
+		BlockBaseRoute + "/{page}/{block}", WebhookRoute, PreviewRoute, PreviewRoute + "/exit", ImageBaseRoute + "/",
+	} {
+		fmt.Fprintf(w, "%s\t-\t-\n", route)
+	}
+	return w.Flush()
+}
+
+func checkTemplatesCommand(args []string) error {
+	var opts options
+	if err := newFlagSet("check-templates", &opts).Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("production", false); err != nil {
+		return err
+	}
+
+	if err := blockRegistry.discover(); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob("src/templates/*.go.html")
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".go.html")
+		if name == "layout" {
+			continue
+		}
+
+		tmpl, err := templates.parsePage(name)
+		if err == nil && tmpl.Lookup("content") == nil {
+			err = fmt.Errorf("%s doesn't define a content template", file)
+		}
+		if err != nil {
+			failed++
+			fmt.Println(color.RedString("✗ %s", name), err)
+			continue
+		}
+		fmt.Println(color.GreenString("✓ %s", name))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of the templates failed to parse", failed)
+	}
+	return nil
+}
+
+func configCommand(args []string) error {
+	var opts options
+	if err := newFlagSet("config", &opts).Parse(args); err != nil {
+		return err
+	}
+	if err := opts.apply("production", true); err != nil {
+		return err
+	}
+
+	fmt.Print(config)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// Custom elements that ship their own bundle, in a file named after their tag
+const customElementsDir = "src/custom-elements"
+
+// Opening tags of custom elements in rendered html, names must contain a hyphen
+var customElementPattern = regexp.MustCompile(`<([a-z][a-z0-9]*-[a-z0-9._-]*)`)
+
+// componentEntries lists the bundles of blocks and custom elements. A block
+// can ship src/components/blocks/hero.ts or hero.css, bundled as block_hero.
+// A custom element ships a file named after its tag, like
+// src/custom-elements/mapbox-component.ts, which registers the element.
+func componentEntries() []api.EntryPoint {
+	entries := []api.EntryPoint{}
+
+	for _, pattern := range []string{"*.ts", "*.css"} {
+		files, _ := filepath.Glob(filepath.Join(blocksDir, pattern))
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			entries = append(entries, api.EntryPoint{InputPath: file, OutputPath: "block_" + name})
+		}
+
+		files, _ = filepath.Glob(filepath.Join(customElementsDir, pattern))
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			if !customElementPattern.MatchString("<" + name) {
+				continue // a module the elements import, like mapbox.ts
+			}
+			entries = append(entries, api.EntryPoint{InputPath: file, OutputPath: name})
+		}
+	}
+
+	return entries
+}
+
+// isComponentAsset reports whether a changed file is bundled as a component
+// entry, so the watcher rebuilds the scripts for css files too
+func isComponentAsset(path string) bool {
+	dir := filepath.Dir(filepath.Clean(path))
+	return dir == filepath.Clean(blocksDir) || dir == filepath.Clean(customElementsDir)
+}
+
+// componentAssets builds the tags that load the bundles of the given block
+// collections and of the custom elements used in html, in the order they
+// first appear. Components without a bundle are skipped.
+func componentAssets(html []byte, collections []string) string {
+	names := []string{}
+	for _, collection := range collections {
+		if !slices.Contains(names, collection) {
+			names = append(names, collection)
+		}
+	}
+	for _, match := range customElementPattern.FindAllSubmatch(html, -1) {
+		if name := string(match[1]); !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	var tags strings.Builder
+	preloaded := map[string]bool{}
+	for _, name := range names {
+		if url, found := manifest.lookup(name + ".css"); found {
+			tags.WriteString(`<link rel="stylesheet" href="` + url + `" data-asset="` + name + `.css" />`)
+		}
+		if url, found := manifest.lookup(name + ".js"); found {
+			for _, chunk := range manifest.chunks(name + ".js") {
+				if !preloaded[chunk] {
+					preloaded[chunk] = true
+					tags.WriteString(`<link rel="modulepreload" href="` + chunk + `" />`)
+				}
+			}
+			tags.WriteString(`<script type="module" src="` + url + `"></script>`)
+		}
+	}
+	return tags.String()
+}
+
+// injectComponentAssets adds the component bundles to rendered html, at the
+// end of the head of a full page, or in front of a boosted body or a block
+func injectComponentAssets(html []byte, collections []string) []byte {
+	tags := componentAssets(html, collections)
+	if tags == "" {
+		return html
+	}
+
+	out := make([]byte, 0, len(html)+len(tags))
+	if i := bytes.Index(html, []byte("</head>")); i >= 0 {
+		out = append(out, html[:i]...)
+		out = append(out, tags...)
+		return append(out, html[i:]...)
+	}
+	out = append(out, tags...)
+	return append(out, html...)
+}
+
+// The block collections of a page, their bundles load with it even when the
+// block itself is lazy
+func blockCollections(blocks []Block) []string {
+	collections := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		collections = append(collections, block.Collection)
+	}
+	return collections
+}
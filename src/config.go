@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the app. It's loaded once at startup from the
+// defaults, then an optional cookie.toml or cookie.yaml, then the environment
+// (including .env), then the command line flags, each overriding the last.
+type Config struct {
+	Env           string          `toml:"env" yaml:"env"`   // development or production
+	Port          int             `toml:"port" yaml:"port"` // env PORT
+	Database      DatabaseConfig  `toml:"database" yaml:"database"`
+	Content       ContentConfig   `toml:"content" yaml:"content"`
+	PageCache     PageCacheConfig `toml:"page_cache" yaml:"page_cache"`
+	HTTPCache     HTTPCacheConfig `toml:"http_cache" yaml:"http_cache"`
+	Assets        AssetsConfig    `toml:"assets" yaml:"assets"`
+	Images        ImagesConfig    `toml:"images" yaml:"images"`
+	LiveReload    bool            `toml:"live_reload" yaml:"live_reload"`       // reload browsers on file changes, development only
+	RelationDepth int             `toml:"relation_depth" yaml:"relation_depth"` // levels of relations expanded in block data, 0 disables it
+	WebhookSecret string          `toml:"webhook_secret" yaml:"webhook_secret"`
+	PreviewSecret string          `toml:"preview_secret" yaml:"preview_secret"`
+}
+
+type DatabaseConfig struct {
+	URL             string        `toml:"url" yaml:"url"` // a postgres:// DSN, used instead of the fields below when set
+	Host            string        `toml:"host" yaml:"host"`
+	Port            int           `toml:"port" yaml:"port"`
+	Name            string        `toml:"name" yaml:"name"`
+	User            string        `toml:"user" yaml:"user"`
+	Password        string        `toml:"password" yaml:"password"`
+	SSLMode         string        `toml:"sslmode" yaml:"sslmode"`
+	MaxOpenConns    int           `toml:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns    int           `toml:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `toml:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+	NotifyChannel   string        `toml:"notify_channel" yaml:"notify_channel"` // LISTEN for cache invalidations on this channel
+	NotifyMigrate   bool          `toml:"notify_migrate" yaml:"notify_migrate"` // install the NOTIFY triggers at startup
+}
+
+type ContentConfig struct {
+	Source        string `toml:"source" yaml:"source"` // postgres, directus or filesystem
+	Dir           string `toml:"dir" yaml:"dir"`       // for the filesystem source
+	DirectusURL   string `toml:"directus_url" yaml:"directus_url"`
+	DirectusToken string `toml:"directus_token" yaml:"directus_token"`
+}
+
+// Cache-Control of rendered pages
+type HTTPCacheConfig struct {
+	Default   CachePolicy            `toml:"default" yaml:"default"`
+	Templates map[string]CachePolicy `toml:"templates" yaml:"templates"` // per page template, e.g. [http_cache.templates.404]
+}
+
+type AssetsConfig struct {
+	MaxAge   time.Duration `toml:"max_age" yaml:"max_age"`   // Cache-Control max-age of static files, built css and js are immutable
+	Tailwind bool          `toml:"tailwind" yaml:"tailwind"` // run the styles through tailwind (postcss), otherwise esbuild only
+}
+
+type ImagesConfig struct {
+	Widths   []int         `toml:"widths" yaml:"widths"`       // srcset widths, capped at max_width
+	MaxWidth int           `toml:"max_width" yaml:"max_width"` // width of the src fallback
+	MaxAge   time.Duration `toml:"max_age" yaml:"max_age"`     // Cache-Control max-age of optimized images
+	WebP     bool          `toml:"webp" yaml:"webp"`           // serve webp to browsers that accept it
+	Quality  int           `toml:"quality" yaml:"quality"`     // jpeg and webp quality, 1-100
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Env:  "production",
+		Port: 42069,
+		Database: DatabaseConfig{
+			Host:            "database",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 5 * time.Minute,
+		},
+		Content: ContentConfig{
+			Source: "postgres",
+			Dir:    "content",
+		},
+		PageCache: defaultPageCacheConfig,
+		HTTPCache: defaultHTTPCacheConfig(),
+		Assets: AssetsConfig{
+			MaxAge:   180 * 24 * time.Hour,
+			Tailwind: true,
+		},
+		Images: ImagesConfig{
+			Widths:   []int{320, 480, 640, 768, 1024, 1280, 1600},
+			MaxWidth: 1920,
+			MaxAge:   180 * 24 * time.Hour,
+			WebP:     true,
+			Quality:  80,
+		},
+		LiveReload:    true,
+		RelationDepth: 2,
+	}
+}
+
+// Config files looked up in the working directory when --config isn't given
+var configFiles = []string{"cookie.toml", "cookie.yaml", "cookie.yml"}
+
+// loadConfig builds the config for a command. configFile may be a TOML or
+// YAML config file, or an env file that is loaded instead of .env.
+func loadConfig(defaultEnv string, configFile string) (Config, error) {
+	c := defaultConfig()
+	c.Env = defaultEnv
+
+	envFile := ".env"
+	if configFile == "" {
+		for _, file := range configFiles {
+			if fileExists(file) {
+				configFile = file
+				break
+			}
+		}
+	} else if ext := filepath.Ext(configFile); ext != ".toml" && ext != ".yaml" && ext != ".yml" {
+		// anything else is an env file, loaded instead of .env
+		envFile, configFile = configFile, ""
+	}
+
+	if configFile != "" {
+		if err := c.loadFile(configFile); err != nil {
+			return c, err
+		}
+	}
+
+	// variables that are already set are never overridden by the env file
+	if envFile != ".env" || fileExists(".env") {
+		if err := godotenv.Load(envFile); err != nil {
+			return c, fmt.Errorf("loading %s: %w", envFile, err)
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(file string) error {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Ext(file) == ".toml" {
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(source), c)
+		if undecoded := meta.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown keys %v", undecoded)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(source))
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// Override the config with the environment variables that are set
+func (c *Config) loadEnv() error {
+	env := envReader{}
+	env.string("APP_ENV", &c.Env)
+	env.int("PORT", &c.Port)
+
+	env.string("DATABASE_URL", &c.Database.URL)
+	env.string("DB_HOST", &c.Database.Host)
+	env.int("DB_PORT", &c.Database.Port)
+	env.string("DB_NAME", &c.Database.Name)
+	env.string("DB_USER", &c.Database.User)
+	env.string("DB_PASSWORD", &c.Database.Password)
+	env.string("DB_SSLMODE", &c.Database.SSLMode)
+	env.int("DB_MAX_OPEN_CONNS", &c.Database.MaxOpenConns)
+	env.int("DB_MAX_IDLE_CONNS", &c.Database.MaxIdleConns)
+	env.duration("DB_CONN_MAX_LIFETIME", &c.Database.ConnMaxLifetime)
+	env.string("DB_NOTIFY_CHANNEL", &c.Database.NotifyChannel)
+	env.bool("DB_NOTIFY_MIGRATE", &c.Database.NotifyMigrate)
+
+	env.string("CONTENT_SOURCE", &c.Content.Source)
+	env.string("CONTENT_DIR", &c.Content.Dir)
+	env.string("DIRECTUS_URL", &c.Content.DirectusURL)
+	env.string("DIRECTUS_TOKEN", &c.Content.DirectusToken)
+
+	env.duration("PAGE_CACHE_TTL", &c.PageCache.TTL)
+	env.duration("PAGE_CACHE_MAX_STALE", &c.PageCache.MaxStale)
+	env.duration("PAGE_CACHE_NOT_FOUND_TTL", &c.PageCache.NotFoundTTL)
+	env.int("PAGE_CACHE_MAX_ENTRIES", &c.PageCache.MaxEntries)
+
+	env.duration("ASSET_MAX_AGE", &c.Assets.MaxAge)
+	env.bool("ASSET_TAILWIND", &c.Assets.Tailwind)
+	env.ints("IMAGE_WIDTHS", &c.Images.Widths)
+	env.int("IMAGE_MAX_WIDTH", &c.Images.MaxWidth)
+	env.duration("IMAGE_MAX_AGE", &c.Images.MaxAge)
+	env.bool("IMAGE_WEBP", &c.Images.WebP)
+	env.int("IMAGE_QUALITY", &c.Images.Quality)
+
+	env.bool("LIVE_RELOAD", &c.LiveReload)
+
+	env.int("RELATION_DEPTH", &c.RelationDepth)
+	env.string("WEBHOOK_SECRET", &c.WebhookSecret)
+	env.string("PREVIEW_SECRET", &c.PreviewSecret)
+
+	return errors.Join(env.errs...)
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// validate reports every invalid setting at once. The content settings are
+// only checked for commands that load content.
+func (c Config) validate(withContent bool) error {
+	errs := []error{}
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Env != "development" && c.Env != "production" {
+		invalid("env: %q must be development or production", c.Env)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		invalid("port: %d is not a valid port", c.Port)
+	}
+
+	if withContent {
+		switch c.Content.Source {
+		case "postgres":
+			if c.Database.URL != "" {
+				dsn, err := url.Parse(c.Database.URL)
+				if err != nil {
+					invalid("database.url: %v", err)
+				} else if dsn.Scheme != "postgres" && dsn.Scheme != "postgresql" {
+					invalid("database.url: scheme must be postgres:// or postgresql://, not %q", dsn.Scheme)
+				} else if mode := dsn.Query().Get("sslmode"); mode != "" && !slices.Contains(sslModes, mode) {
+					invalid("database.url: sslmode %q must be one of %s", mode, strings.Join(sslModes, ", "))
+				}
+			} else {
+				if c.Database.Name == "" || c.Database.User == "" {
+					invalid("database: set DATABASE_URL, or DB_NAME and DB_USER")
+				}
+				if !slices.Contains(sslModes, c.Database.SSLMode) {
+					invalid("database.sslmode: %q must be one of %s", c.Database.SSLMode, strings.Join(sslModes, ", "))
+				}
+			}
+			if c.Database.MaxOpenConns < 1 || c.Database.MaxIdleConns < 0 {
+				invalid("database: max_open_conns must be at least 1 and max_idle_conns can't be negative")
+			}
+		case "directus":
+			if c.Content.DirectusURL == "" {
+				invalid("content.directus_url: DIRECTUS_URL is required for the directus content source")
+			}
+		case "filesystem":
+			if c.Content.Dir == "" {
+				invalid("content.dir: required for the filesystem content source")
+			}
+		default:
+			invalid("content.source: %q must be postgres, directus or filesystem", c.Content.Source)
+		}
+	}
+
+	if c.PageCache.TTL < 0 || c.PageCache.MaxStale < 0 || c.PageCache.NotFoundTTL < 0 {
+		invalid("page_cache: durations can't be negative")
+	}
+	if c.PageCache.MaxEntries < 1 {
+		invalid("page_cache.max_entries: must be at least 1")
+	}
+	if c.Assets.MaxAge < 0 || c.Images.MaxAge < 0 {
+		invalid("max_age: durations can't be negative")
+	}
+	if c.Images.MaxWidth < 1 {
+		invalid("images.max_width: must be at least 1")
+	}
+	policies := map[string]CachePolicy{"default": c.HTTPCache.Default}
+	for name, policy := range c.HTTPCache.Templates {
+		policies["templates."+name] = policy
+	}
+	for name, policy := range policies {
+		if policy.MaxAge < 0 || policy.StaleWhileRevalidate < 0 {
+			invalid("http_cache.%s: max_age and stale_while_revalidate can't be negative", name)
+		}
+	}
+	if c.Images.Quality < 1 || c.Images.Quality > 100 {
+		invalid("images.quality: %d must be between 1 and 100", c.Images.Quality)
+	}
+	if !sort.IntsAreSorted(c.Images.Widths) || (len(c.Images.Widths) > 0 && c.Images.Widths[0] < 1) {
+		invalid("images.widths: %v must be positive and in ascending order", c.Images.Widths)
+	}
+	if c.RelationDepth < 0 {
+		invalid("relation_depth: can't be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// dsn is the lib/pq connection string, which also accepts postgres:// urls
+func (d DatabaseConfig) dsn() string {
+	if d.URL != "" {
+		return d.URL
+	}
+
+	dsn := "sslmode=" + d.SSLMode
+	dsn += " user=" + quoteDSN(d.User)
+	dsn += " dbname=" + quoteDSN(d.Name)
+	dsn += " password=" + quoteDSN(d.Password)
+	dsn += " host=" + quoteDSN(d.Host)
+	if d.Port != 0 {
+		dsn += " port=" + strconv.Itoa(d.Port)
+	}
+	return dsn
+}
+
+// Quote values with spaces or quotes, as expected by lib/pq
+func quoteDSN(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, `'`, `\'`) + "'"
+}
+
+// redacted returns a copy of the config that is safe to print
+func (c Config) redacted() Config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+	redact(&c.Database.Password)
+	redact(&c.Content.DirectusToken)
+	redact(&c.WebhookSecret)
+	redact(&c.PreviewSecret)
+
+	c.Database.URL = redactDSN(c.Database.URL)
+	return c
+}
+
+// Connection string parameters that hold secrets, besides the url's userinfo
+var dsnSecrets = []string{"password", "sslpassword"}
+
+var dsnSecretPattern = regexp.MustCompile(`\b((?:ssl)?password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactDSN masks the passwords in a postgres:// url or a key=value
+// connection string
+func redactDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsnSecretPattern.ReplaceAllString(dsn, "${1}REDACTED")
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		// can't tell where the secrets are
+		return "REDACTED"
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		}
+	}
+	query := u.Query()
+	for _, key := range dsnSecrets {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+			u.RawQuery = query.Encode()
+		}
+	}
+	return u.String()
+}
+
+// String prints the config as TOML with the secrets redacted
+func (c Config) String() string {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c.redacted()); err != nil {
+		return err.Error()
+	}
+	return buf.String()
+}
+
+func (c Config) isDevelopment() bool {
+	return c.Env == "development"
+}
+
+// envReader reads environment variables into config fields, keeping the
+// current value when a variable isn't set and collecting parse errors.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) lookup(key string) (string, bool) {
+	value, ok := os.LookupEnv(key)
+	return strings.TrimSpace(value), ok && strings.TrimSpace(value) != ""
+}
+
+func (e *envReader) string(key string, into *string) {
+	if value, ok := e.lookup(key); ok {
+		*into = value
+	}
+}
+
+func (e *envReader) int(key string, into *int) {
+	if value, ok := e.lookup(key); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not a number", key, value))
+			return
+		}
+		*into = parsed
+	}
+}
+
+func (e *envReader) bool(key string, into *bool) {
+	if value, ok := e.lookup(key); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not true or false", key, value))
+			return
+		}
+		*into = parsed
+	}
+}
+
+func (e *envReader) duration(key string, into *time.Duration) {
+	if value, ok := e.lookup(key); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not a duration like 10s or 5m", key, value))
+			return
+		}
+		*into = parsed
+	}
+}
+
+func (e *envReader) ints(key string, into *[]int) {
+	if value, ok := e.lookup(key); ok {
+		parsed := []int{}
+		for _, part := range strings.Split(value, ",") {
+			number, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				e.errs = append(e.errs, fmt.Errorf("%s: %q is not a comma separated list of numbers", key, value))
+				return
+			}
+			parsed = append(parsed, number)
+		}
+		*into = parsed
+	}
+}
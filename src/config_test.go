@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tests := map[string]string{
+		"postgres://cookie:s3cret@db/cookie?sslmode=disable":             "postgres://cookie:REDACTED@db/cookie?sslmode=disable",
+		"postgres://cookie@db/cookie?password=s3cret":                    "postgres://cookie@db/cookie?password=REDACTED",
+		"postgres://db/cookie?sslmode=verify-full&sslpassword=s3cret":    "postgres://db/cookie?sslmode=verify-full&sslpassword=REDACTED",
+		"postgres://db/cookie?sslmode=disable":                           "postgres://db/cookie?sslmode=disable",
+		"host=db user=cookie password=s3cret dbname=cookie":              "host=db user=cookie password=REDACTED dbname=cookie",
+		"host=db password='with spaces \\' s3cret' sslpassword = s3cret": "host=db password=REDACTED sslpassword = REDACTED",
+		"postgres://cookie:s3cret@db:port/cookie":                        "REDACTED",
+	}
+	for dsn, want := range tests {
+		if got := redactDSN(dsn); got != want {
+			t.Errorf("redactDSN(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	c := defaultConfig()
+	c.Database.URL = "postgres://cookie@db/cookie?password=s3cret"
+	c.Database.Password = "s3cret"
+	c.WebhookSecret = "s3cret"
+	c.PreviewSecret = "s3cret"
+	c.Content.DirectusToken = "s3cret"
+
+	if printed := c.String(); strings.Contains(printed, "s3cret") {
+		t.Errorf("printed config contains a secret:\n%s", printed)
+	}
+}
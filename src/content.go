@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	errPageNotFound  = errors.New("page not found")
+	errBlockNotFound = errors.New("block not found")
+)
+
+// ContentSource is where pages and their blocks come from. Implementations
+// return errPageNotFound and errBlockNotFound when nothing matches.
+type ContentSource interface {
+	// Get a published page with its blocks by uri, "/" is the home page
+	GetPageByURI(ctx context.Context, uri string) (Page, error)
+	// List all published pages, without their blocks
+	ListPages(ctx context.Context) ([]Page, error)
+	// Get a single block of a page by its page_blocks id
+	GetBlock(ctx context.Context, pageID int, blockID int) (Block, error)
+	// Get a page by uri whatever its status, for preview mode. A non zero
+	// revision is a directus_revisions id to show instead of the saved item.
+	GetPreviewPage(ctx context.Context, uri string, revision int) (Page, error)
+}
+
+var content ContentSource = sqlSource{}
+
+// Select the content source from CONTENT_SOURCE:
+//   - postgres (default) reads straight from the Directus database
+//   - directus uses the Directus REST API at DIRECTUS_URL with DIRECTUS_TOKEN
+//   - filesystem reads Markdown pages from CONTENT_DIR (default content), no database needed
+func initContentSource() error {
+	switch source := config.Content.Source; source {
+	case "", "postgres":
+		content = sqlSource{}
+		return initDB()
+	case "directus":
+		if config.Content.DirectusURL == "" {
+			return errors.New("DIRECTUS_URL is required for the directus content source")
+		}
+		content = newDirectusSource(config.Content.DirectusURL, config.Content.DirectusToken, &http.Client{Timeout: 10 * time.Second})
+		return nil
+	case "filesystem":
+		dir := config.Content.Dir
+		if _, err := os.Stat(dir); err != nil {
+			return err
+		}
+		content = newFsSource(dir)
+		return nil
+	default:
+		return fmt.Errorf("unknown CONTENT_SOURCE %q", source)
+	}
+}
+
+// Page loads aren't tied to a single request, they are cancelled when the
+// server shuts down
+var loadContext, cancelLoads = context.WithCancel(context.Background())
+
+// Loads pages into the page cache
+func loadPage(uri string) (Page, error) {
+	return content.GetPageByURI(loadContext, uri)
+}
+
+// sqlSource reads pages and blocks from the Directus Postgres database
+type sqlSource struct{}
+
+func (sqlSource) GetPageByURI(ctx context.Context, uri string) (Page, error) {
+	return queryPageDataFromDB(ctx, uri)
+}
+
+func (sqlSource) ListPages(ctx context.Context) ([]Page, error) {
+	return queryPagesFromDB(ctx)
+}
+
+func (sqlSource) GetBlock(ctx context.Context, pageID int, blockID int) (Block, error) {
+	return queryBlockFromDB(ctx, pageID, blockID)
+}
+
+func (sqlSource) GetPreviewPage(ctx context.Context, uri string, revisionID int) (Page, error) {
+	page, err := queryPageWithStatuses(ctx, uri, previewStatuses)
+	if err != nil {
+		return Page{}, err
+	}
+
+	if revisionID != 0 {
+		revision, err := queryRevisionFromDB(ctx, revisionID)
+		if err != nil {
+			return Page{}, err
+		}
+		applyRevision(&page, revision)
+	}
+
+	page.Preview = true
+	return page, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Queries of a cancelled request stop, rather than loading a page nobody waits for
+func TestSQLSourceCancelled(t *testing.T) {
+	// never connects, a cancelled context fails before a connection is made
+	conn, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer func(previous *sqlx.DB) { db = previous }(db)
+	db = conn
+	defer resetRelationsMetadata()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	source := sqlSource{}
+	if _, err := source.GetPageByURI(ctx, "/"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetPageByURI error = %v, want context.Canceled", err)
+	}
+	if _, err := source.ListPages(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListPages error = %v, want context.Canceled", err)
+	}
+	if _, err := source.GetBlock(ctx, 1, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetBlock error = %v, want context.Canceled", err)
+	}
+	if _, err := source.GetPreviewPage(ctx, "/", 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetPreviewPage error = %v, want context.Canceled", err)
+	}
+	if _, err := queryBlocks(ctx, []BlockData{{Collection: "block_hero", Item: "1"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("queryBlocks error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,6 @@
+import { registerComponents } from "@/core/register-components";
+import { ExampleTimerComponent } from "@/custom-elements/example";
+
+registerComponents({
+  "example-timer": ExampleTimerComponent,
+});
@@ -0,0 +1,7 @@
+import { registerComponents } from "@/core/register-components";
+import { MapboxComponent } from "@/custom-elements/mapbox";
+
+// Loaded on pages with a <mapbox-component>, so others don't pay for mapbox-gl
+registerComponents({
+  "mapbox-component": MapboxComponent,
+});
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"sync"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Seo struct {
@@ -23,7 +25,10 @@ type Page struct {
 	Status   string         `db:"status"`
 	Title    string         `db:"title"`
 	Template string         `db:"template"`
+	Seo      Seo            `db:"-"` // defaults to the title when empty
+	Preview  bool           `db:"-"` // loaded for preview mode, must never be cached
 	Blocks   []Block
+	CachedAt time.Time `db:"-"` // when the page data was loaded into the page cache
 }
 
 type BlockData struct {
@@ -35,60 +40,19 @@ type BlockData struct {
 }
 
 type Block struct {
+	ID         int    `db:"id"` // id of the page_blocks row
+	PageID     int    `db:"page_id"`
 	Collection string `db:"collection"`
+	Item       string `db:"item"` // id of the block in its collection
+	Lazy       bool   // render a skeleton and load the block with htmx once revealed
 	Data       map[string]interface{}
-}
 
-type CacheEntry struct {
-	Page       Page
-	Timestamp  time.Time
-	Stale      bool
-	Refreshing bool // New field to indicate a refresh is in progress
+	// Dependency keys of the related items expanded into Data
+	Dependencies []string
 }
 
-var cacheMutex sync.RWMutex
-
-var (
-	pageCache = make(map[string]CacheEntry)
-	cacheTTL  = 10 * time.Second
-)
-
 func getPageData(pageUrl string) (Page, error) {
-	cacheMutex.RLock()
-	entry, found := pageCache[pageUrl]
-	cacheMutex.RUnlock()
-
-	if found {
-		if time.Since(entry.Timestamp) < cacheTTL {
-			// color.Green("Cache hit for %s", pageUrl)
-			return entry.Page, nil
-		} else {
-			if !entry.Stale || (entry.Stale && !entry.Refreshing) {
-				// color.Yellow("Cache stale for %s", pageUrl)
-				cacheMutex.Lock()
-				if !pageCache[pageUrl].Refreshing { // Check again to avoid race condition
-					entry.Stale = true
-					entry.Refreshing = true // Set the refreshing flag
-					pageCache[pageUrl] = entry
-					go refreshPageData(pageUrl) // Refresh the data in a separate goroutine
-				}
-				cacheMutex.Unlock()
-				return entry.Page, nil
-			}
-		}
-	}
-
-	// color.Red("Cache miss for %s", pageUrl)
-	return queryPageDataFromDB(pageUrl)
-}
-
-func refreshPageData(pageUrl string) {
-	// fmt.Printf("Refreshing cache for %s\n", pageUrl)
-	_, err := queryPageDataFromDB(pageUrl)
-	if err != nil {
-		fmt.Printf("Error refreshing page data for %s: %v\n", pageUrl, err)
-		return
-	}
+	return pageCache.get(pageUrl)
 }
 
 var db *sqlx.DB
@@ -96,87 +60,288 @@ var db *sqlx.DB
 func initDB() error {
 	var err error
 
-	connectionString := "sslmode=disable"
-	connectionString += " user=" + os.Getenv("DB_USER")
-	connectionString += " dbname=" + os.Getenv("DB_NAME")
-	connectionString += " password=" + os.Getenv("DB_PASSWORD")
-	connectionString += " host=" + os.Getenv("DB_HOST")
-
-	db, err = sqlx.Connect("postgres", connectionString)
+	db, err = sqlx.Connect("postgres", config.Database.dsn())
 	if err != nil {
 		return err
 	}
 
 	// Configure the connection pool here
-	db.SetMaxOpenConns(25)                 // Set the maximum number of open connections
-	db.SetMaxIdleConns(10)                 // Set the maximum number of idle connections
-	db.SetConnMaxLifetime(5 * time.Minute) // Set the maximum amount of time a connection may be reused
+	db.SetMaxOpenConns(config.Database.MaxOpenConns)       // Set the maximum number of open connections
+	db.SetMaxIdleConns(config.Database.MaxIdleConns)       // Set the maximum number of idle connections
+	db.SetConnMaxLifetime(config.Database.ConnMaxLifetime) // Set the maximum amount of time a connection may be reused
+
+	// Optionally invalidate cached pages from Postgres notifications
+	if channel := config.Database.NotifyChannel; channel != "" {
+		if config.Database.NotifyMigrate {
+			if err := installNotifyTriggers(channel); err != nil {
+				return err
+			}
+		}
+		if err := listenForChanges(channel); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func queryPageDataFromDB(pageUrl string) (Page, error) {
+func queryPageDataFromDB(ctx context.Context, pageUrl string) (Page, error) {
+	return queryPageWithStatuses(ctx, pageUrl, []string{"published"})
+}
+
+func queryPageWithStatuses(ctx context.Context, pageUrl string, statuses []string) (Page, error) {
 	// fmt.Printf("Querying DB for %s\n", pageUrl)
 
 	var page Page
 	var err error
 	if pageUrl == "/" {
-		err = db.Get(&page, "SELECT id, uri, title, status, template FROM page WHERE uri = '' OR uri IS NULL AND status = 'published'")
+		err = db.GetContext(ctx, &page, "SELECT id, uri, title, status, template FROM page WHERE (uri = '' OR uri IS NULL) AND status = ANY($1)", pq.Array(statuses))
 	} else {
-		err = db.Get(&page, "SELECT id, uri, title, status, template FROM page WHERE uri = $1 AND status = 'published'", pageUrl)
+		err = db.GetContext(ctx, &page, "SELECT id, uri, title, status, template FROM page WHERE uri = $1 AND status = ANY($2)", pageUrl, pq.Array(statuses))
 	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return Page{}, errPageNotFound
+	}
+	if err != nil {
+		return Page{}, err
+	}
+
+	page.Blocks, err = queryPageBlocks(ctx, page.ID)
 	if err != nil {
 		return Page{}, err
 	}
 
+	return page, nil
+}
+
+// Query a revision of an item from directus_revisions
+func queryRevisionFromDB(ctx context.Context, revisionID int) (Revision, error) {
+	var revision Revision
+	var data []byte
+	err := db.QueryRowContext(ctx, "SELECT collection, item, data FROM directus_revisions WHERE id = $1", revisionID).Scan(&revision.Collection, &revision.Item, &data)
+	if err != nil {
+		return Revision{}, err
+	}
+
+	// deletes don't store any data
+	if len(data) == 0 {
+		return revision, nil
+	}
+	if err := json.Unmarshal(data, &revision.Data); err != nil {
+		return Revision{}, fmt.Errorf("revision %d: %w", revisionID, err)
+	}
+	return revision, nil
+}
+
+func queryPageBlocks(ctx context.Context, pageID int) ([]Block, error) {
 	var blocksDatas []BlockData
-	err = db.Select(&blocksDatas, "SELECT collection, id, item, page_id, sort FROM page_blocks WHERE page_id = $1 ORDER BY sort ASC", page.ID)
+	err := db.SelectContext(ctx, &blocksDatas, "SELECT collection, id, item, page_id, sort FROM page_blocks WHERE page_id = $1 ORDER BY sort ASC", pageID)
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	blocks := make([]Block, 0) // Initialize the Blocks map
+	return queryBlocks(ctx, blocksDatas)
+}
+
+// Query a single block of a published page
+func queryBlockFromDB(ctx context.Context, pageID int, blockID int) (Block, error) {
+	var blocksDatas []BlockData
+	err := db.SelectContext(ctx, &blocksDatas, `SELECT b.collection, b.id, b.item, b.page_id, b.sort FROM page_blocks b
+		JOIN page p ON p.id = b.page_id
+		WHERE b.page_id = $1 AND b.id = $2 AND p.status = 'published'`, pageID, blockID)
+	if err != nil {
+		return Block{}, err
+	}
+
+	blocks, err := queryBlocks(ctx, blocksDatas)
+	if err != nil {
+		return Block{}, err
+	}
+	if len(blocks) == 0 {
+		return Block{}, errBlockNotFound
+	}
+	return blocks[0], nil
+}
 
+// Query listing all published pages, without their blocks
+func queryPagesFromDB(ctx context.Context) ([]Page, error) {
+	var pages []Page
+	err := db.SelectContext(ctx, &pages, "SELECT id, uri, title, status, template FROM page WHERE status = 'published' ORDER BY id")
+	return pages, err
+}
+
+// Load the block items for the page_blocks rows, keeping their order. Blocks
+// that fail to load are left out, unless ctx was cancelled: a page missing
+// blocks because of that must not end up in the page cache.
+func queryBlocks(ctx context.Context, blocksDatas []BlockData) ([]Block, error) {
+	// Group the block items by collection so each collection is loaded with one query
+	itemsByCollection := make(map[string][]string)
 	for _, blockData := range blocksDatas {
-		block := Block{
-			Collection: blockData.Collection,
-			Data:       make(map[string]interface{}),
-		}
-		query := fmt.Sprintf("SELECT * FROM %s WHERE id = $1", blockData.Collection)
-		err = db.QueryRowx(query, blockData.Item).MapScan(block.Data)
+		itemsByCollection[blockData.Collection] = append(itemsByCollection[blockData.Collection], blockData.Item)
+	}
 
+	rowsByCollection := make(map[string]map[string]map[string]interface{})
+	depsByCollection := make(map[string][]string)
+	for collection, items := range itemsByCollection {
+		rows, deps, err := queryBlockItems(ctx, collection, items)
 		if err != nil {
 			fmt.Println("Error querying for blocks:", err)
-			fmt.Println("query:", query, blockData.ID)
 			continue
 		}
+		rowsByCollection[collection] = rows
+		depsByCollection[collection] = deps
+	}
 
-		for key, value := range block.Data {
-			switch v := value.(type) {
-			case []byte:
-				// Try to unmarshal as JSON
-				var jsonData interface{}
-				if err := json.Unmarshal(v, &jsonData); err == nil {
-					block.Data[key] = jsonData
-				} else {
-					// If not JSON, convert to string
-					block.Data[key] = string(v)
-				}
-			default:
-				// Handle other types as needed
-			}
+	blocks := make([]Block, 0) // Initialize the Blocks map
+
+	for _, blockData := range blocksDatas {
+		data, ok := rowsByCollection[blockData.Collection][blockData.Item]
+		if !ok {
+			fmt.Printf("Error querying for blocks: %s %s not found\n", blockData.Collection, blockData.Item)
+			continue
+		}
+
+		block := Block{
+			ID:         blockData.ID,
+			PageID:     blockData.PageID,
+			Collection: blockData.Collection,
+			Item:       blockData.Item,
+			Data:       data,
+			Lazy:       isLazyBlock(data),
+			// relations are loaded per collection, so every block of it depends on all of them
+			Dependencies: depsByCollection[blockData.Collection],
 		}
 
 		// Append to the overall list of blocks.
 		blocks = append(blocks, block)
 	}
 
-	page.Blocks = blocks
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
 
-	cacheMutex.Lock()
-	pageCache[pageUrl] = CacheEntry{Page: page, Timestamp: time.Now(), Stale: false}
-	cacheMutex.Unlock()
-	// color.Yellow("Cache updated for %s\n", pageUrl)
+// Directus collection and field names, checked before they are used in a query
+var identifierPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
 
-	return page, nil
+// Load the items of one block collection, keyed by their primary key
+func queryBlockItems(ctx context.Context, collection string, items []string) (map[string]map[string]interface{}, []string, error) {
+	primaryKey := getRelationsMetadata().primaryKey(collection)
+	rows, err := queryItems(ctx, collection, primaryKey, items, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// replace foreign keys with the related items
+	deps, err := expandRelations(ctx, collection, rows, config.RelationDepth)
+	if err != nil {
+		fmt.Println("Error expanding relations:", err)
+	}
+
+	result := make(map[string]map[string]interface{})
+	for _, row := range rows {
+		result[fmt.Sprint(row[primaryKey])] = row
+	}
+	return result, deps, nil
+}
+
+// Load the items of a collection where field is one of values, optionally sorted by sortField
+func queryItems(ctx context.Context, collection string, field string, values []string, sortField string) ([]map[string]interface{}, error) {
+	for _, name := range []string{collection, field, sortField} {
+		if name != "" && !identifierPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid identifier %q", name)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s = ANY($1)", pq.QuoteIdentifier(collection), pq.QuoteIdentifier(field))
+	if sortField != "" {
+		query += " ORDER BY " + pq.QuoteIdentifier(sortField)
+	}
+
+	rows, err := db.QueryxContext(ctx, query, pq.Array(values))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", collection, err)
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		data := make(map[string]interface{})
+		if err := rows.MapScan(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", collection, err)
+		}
+
+		for _, columnType := range columnTypes {
+			data[columnType.Name()] = decodeColumn(columnType.DatabaseTypeName(), data[columnType.Name()])
+		}
+		result = append(result, data)
+	}
+
+	return result, rows.Err()
+}
+
+// Convert the raw values from the driver based on the Postgres column type.
+// The driver already returns numbers, booleans and timestamps as Go types.
+func decodeColumn(databaseType string, value interface{}) interface{} {
+	raw, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+
+	switch databaseType {
+	case "JSON", "JSONB":
+		var jsonData interface{}
+		if err := json.Unmarshal(raw, &jsonData); err != nil {
+			return string(raw)
+		}
+		return jsonData
+	case "BYTEA":
+		return raw
+	default:
+		// text, varchar, uuid, numeric etc.
+		return string(raw)
+	}
+}
+
+// Keys of the Directus items a page was built from, used to find the cached
+// pages to invalidate when one of them changes
+func (page Page) dependencies() []string {
+	deps := []string{dependencyKey("page", page.ID)}
+	for _, block := range page.Blocks {
+		deps = append(deps,
+			dependencyKey("page_blocks", block.ID),
+			dependencyKey(block.Collection, block.Item),
+		)
+		deps = append(deps, block.Dependencies...)
+	}
+	return deps
+}
+
+// The key of an item, ids decoded from json as float64 are formatted without
+// an exponent so 1000000 gives "page:1000000" like the int from the database
+func dependencyKey(collection string, id interface{}) string {
+	switch id := id.(type) {
+	case float64:
+		return collection + ":" + strconv.FormatFloat(id, 'f', -1, 64)
+	case json.Number:
+		return collection + ":" + id.String()
+	}
+	return fmt.Sprintf("%s:%v", collection, id)
+}
+
+// Blocks opt into lazy loading with a "lazy" boolean field in Directus
+func isLazyBlock(data map[string]interface{}) bool {
+	switch lazy := data["lazy"].(type) {
+	case bool:
+		return lazy
+	case string:
+		return lazy == "true"
+	}
+	return false
 }
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// directusSource reads pages and blocks through the Directus REST API, for
+// projects without direct access to the database. Relations are expanded by
+// Directus itself, up to config.RelationDepth levels.
+type directusSource struct {
+	baseURL string
+	token   string
+	client  *http.Client
+
+	// relations and primary keys from /relations and /fields, loaded once
+	relationsMu sync.Mutex
+	relations   *relationsMetadata
+}
+
+func newDirectusSource(baseURL string, token string, client *http.Client) *directusSource {
+	return &directusSource{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  client,
+	}
+}
+
+type directusPage struct {
+	ID       int     `json:"id"`
+	Uri      *string `json:"uri"`
+	Status   string  `json:"status"`
+	Title    string  `json:"title"`
+	Template *string `json:"template"`
+}
+
+func (p directusPage) toPage() Page {
+	page := Page{
+		ID:     p.ID,
+		Status: p.Status,
+		Title:  p.Title,
+	}
+	if p.Uri != nil {
+		page.Uri.String, page.Uri.Valid = *p.Uri, true
+	}
+	if p.Template != nil {
+		page.Template = *p.Template
+	}
+	return page
+}
+
+type directusPageBlock struct {
+	ID         int         `json:"id"`
+	Collection string      `json:"collection"`
+	Item       directusKey `json:"item"`
+	PageID     int         `json:"page_id"`
+}
+
+// directusKey is the key of an item, a number or a string like a uuid
+type directusKey string
+
+func (k *directusKey) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		return json.Unmarshal(data, (*string)(k))
+	}
+	if string(data) == "null" {
+		*k = ""
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	*k = directusKey(number)
+	return nil
+}
+
+const directusPageFields = "id,uri,title,status,template"
+const directusPageBlockFields = "id,collection,item,page_id"
+
+func (d *directusSource) GetPageByURI(ctx context.Context, uri string) (Page, error) {
+	return d.getPage(ctx, uri, []string{"published"})
+}
+
+func (d *directusSource) GetPreviewPage(ctx context.Context, uri string, revisionID int) (Page, error) {
+	page, err := d.getPage(ctx, uri, previewStatuses)
+	if err != nil {
+		return Page{}, err
+	}
+
+	if revisionID != 0 {
+		var revision struct {
+			Collection string                 `json:"collection"`
+			Item       string                 `json:"item"`
+			Data       map[string]interface{} `json:"data"`
+		}
+		query := url.Values{}
+		query.Set("fields", "collection,item,data")
+		if err := d.get(ctx, fmt.Sprintf("/revisions/%d", revisionID), query, &revision); err != nil {
+			return Page{}, err
+		}
+		revision.Data, _ = normalizeNumbers(revision.Data).(map[string]interface{})
+		applyRevision(&page, Revision(revision))
+	}
+
+	page.Preview = true
+	return page, nil
+}
+
+func (d *directusSource) getPage(ctx context.Context, uri string, statuses []string) (Page, error) {
+	filter := map[string]interface{}{
+		"_and": []interface{}{
+			map[string]interface{}{"status": map[string]interface{}{"_in": statuses}},
+			map[string]interface{}{"uri": map[string]interface{}{"_eq": uri}},
+		},
+	}
+	if uri == "/" {
+		filter["_and"].([]interface{})[1] = map[string]interface{}{
+			"_or": []interface{}{
+				map[string]interface{}{"uri": map[string]interface{}{"_null": true}},
+				map[string]interface{}{"uri": map[string]interface{}{"_empty": true}},
+			},
+		}
+	}
+
+	var pages []directusPage
+	err := d.getItems(ctx, "page", filter, directusPageFields, "", 1, &pages)
+	if err != nil {
+		return Page{}, err
+	}
+	if len(pages) == 0 {
+		return Page{}, errPageNotFound
+	}
+
+	page := pages[0].toPage()
+
+	var pageBlocks []directusPageBlock
+	err = d.getItems(ctx, "page_blocks", map[string]interface{}{
+		"page_id": map[string]interface{}{"_eq": page.ID},
+	}, directusPageBlockFields, "sort", -1, &pageBlocks)
+	if err != nil {
+		return Page{}, err
+	}
+
+	page.Blocks, err = d.getBlocks(ctx, pageBlocks)
+	if err != nil {
+		return Page{}, err
+	}
+
+	return page, nil
+}
+
+func (d *directusSource) ListPages(ctx context.Context) ([]Page, error) {
+	var directusPages []directusPage
+	err := d.getItems(ctx, "page", map[string]interface{}{
+		"status": map[string]interface{}{"_eq": "published"},
+	}, directusPageFields, "id", -1, &directusPages)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make([]Page, len(directusPages))
+	for i, page := range directusPages {
+		pages[i] = page.toPage()
+	}
+	return pages, nil
+}
+
+func (d *directusSource) GetBlock(ctx context.Context, pageID int, blockID int) (Block, error) {
+	var pageBlocks []directusPageBlock
+	err := d.getItems(ctx, "page_blocks", map[string]interface{}{
+		"id": map[string]interface{}{"_eq": blockID},
+		// blocks of drafts and archived pages are only served in preview
+		"page_id": map[string]interface{}{
+			"id":     map[string]interface{}{"_eq": pageID},
+			"status": map[string]interface{}{"_eq": "published"},
+		},
+	}, directusPageBlockFields, "", 1, &pageBlocks)
+	if err != nil {
+		return Block{}, err
+	}
+
+	blocks, err := d.getBlocks(ctx, pageBlocks)
+	if err != nil {
+		return Block{}, err
+	}
+	if len(blocks) == 0 {
+		return Block{}, errBlockNotFound
+	}
+	return blocks[0], nil
+}
+
+// Load the block items with one request per collection, keeping the order of the page blocks
+func (d *directusSource) getBlocks(ctx context.Context, pageBlocks []directusPageBlock) ([]Block, error) {
+	itemsByCollection := make(map[string][]string)
+	for _, pageBlock := range pageBlocks {
+		itemsByCollection[pageBlock.Collection] = append(itemsByCollection[pageBlock.Collection], string(pageBlock.Item))
+	}
+
+	meta := d.relationsMetadata(ctx)
+	fields := "*" + strings.Repeat(".*", config.RelationDepth)
+	rowsByCollection := make(map[string]map[string]map[string]interface{})
+	for collection, items := range itemsByCollection {
+		primaryKey := meta.primaryKey(collection)
+		var rows []map[string]interface{}
+		err := d.getItems(ctx, collection, map[string]interface{}{
+			primaryKey: map[string]interface{}{"_in": items},
+		}, fields, "", -1, &rows)
+		if err != nil {
+			fmt.Println("Error querying for blocks:", err)
+			continue
+		}
+
+		rowsByCollection[collection] = make(map[string]map[string]interface{})
+		for _, row := range rows {
+			// numbers as the database backend returns them, not json.Number
+			row = normalizeNumbers(row).(map[string]interface{})
+			rowsByCollection[collection][fmt.Sprint(row[primaryKey])] = row
+		}
+	}
+
+	blocks := make([]Block, 0)
+	for _, pageBlock := range pageBlocks {
+		data, ok := rowsByCollection[pageBlock.Collection][string(pageBlock.Item)]
+		if !ok {
+			fmt.Printf("Error querying for blocks: %s %s not found\n", pageBlock.Collection, pageBlock.Item)
+			continue
+		}
+
+		blocks = append(blocks, Block{
+			ID:           pageBlock.ID,
+			PageID:       pageBlock.PageID,
+			Collection:   pageBlock.Collection,
+			Item:         string(pageBlock.Item),
+			Data:         data,
+			Lazy:         isLazyBlock(data),
+			Dependencies: relatedDependencies(meta, pageBlock.Collection, data),
+		})
+	}
+	return blocks, nil
+}
+
+// The relations and primary keys of the collections, read from /relations
+// and /fields. Without access to them blocks only depend on their own item.
+func (d *directusSource) relationsMetadata(ctx context.Context) *relationsMetadata {
+	d.relationsMu.Lock()
+	defer d.relationsMu.Unlock()
+
+	if d.relations != nil {
+		return d.relations
+	}
+
+	meta := &relationsMetadata{
+		m2o:         make(map[string][]Relation),
+		o2m:         make(map[string][]Relation),
+		junction:    make(map[string]bool),
+		primaryKeys: make(map[string]string),
+	}
+
+	var relations []struct {
+		Collection        string  `json:"collection"`
+		Field             string  `json:"field"`
+		RelatedCollection *string `json:"related_collection"`
+		Meta              *struct {
+			OneField      *string `json:"one_field"`
+			JunctionField *string `json:"junction_field"`
+		} `json:"meta"`
+	}
+	if err := d.get(ctx, "/relations", url.Values{}, &relations); err != nil {
+		fmt.Println("Error querying relations:", err)
+		return meta
+	}
+	var fields []struct {
+		Collection string `json:"collection"`
+		Field      string `json:"field"`
+		Schema     *struct {
+			IsPrimaryKey bool `json:"is_primary_key"`
+		} `json:"schema"`
+	}
+	if err := d.get(ctx, "/fields", url.Values{}, &fields); err != nil {
+		fmt.Println("Error querying fields:", err)
+		return meta
+	}
+
+	for _, relation := range relations {
+		// M2A relations (like page_blocks.item) have no single related collection
+		if relation.RelatedCollection == nil {
+			continue
+		}
+		r := Relation{ManyCollection: relation.Collection, ManyField: relation.Field}
+		r.OneCollection.String, r.OneCollection.Valid = *relation.RelatedCollection, true
+		if relation.Meta != nil && relation.Meta.OneField != nil {
+			r.OneField.String, r.OneField.Valid = *relation.Meta.OneField, true
+		}
+		if relation.Meta != nil && relation.Meta.JunctionField != nil {
+			r.JunctionField.String, r.JunctionField.Valid = *relation.Meta.JunctionField, true
+		}
+		meta.m2o[r.ManyCollection] = append(meta.m2o[r.ManyCollection], r)
+		if r.OneField.Valid {
+			meta.o2m[r.OneCollection.String] = append(meta.o2m[r.OneCollection.String], r)
+		}
+	}
+	for _, field := range fields {
+		if field.Schema != nil && field.Schema.IsPrimaryKey {
+			meta.primaryKeys[field.Collection] = field.Field
+		}
+	}
+
+	d.relations = meta
+	return meta
+}
+
+// Drop the loaded relations, e.g. after the Directus schema changed
+func (d *directusSource) resetRelations() {
+	d.relationsMu.Lock()
+	d.relations = nil
+	d.relationsMu.Unlock()
+}
+
+// relatedDependencies returns the dependency keys of the related items
+// Directus expanded into the data of an item of collection
+func relatedDependencies(meta *relationsMetadata, collection string, data map[string]interface{}) []string {
+	deps := []string{}
+	for _, relation := range meta.m2o[collection] {
+		if related, ok := data[relation.ManyField].(map[string]interface{}); ok {
+			target := relation.OneCollection.String
+			deps = append(deps, dependencyKey(target, related[meta.primaryKey(target)]))
+			deps = append(deps, relatedDependencies(meta, target, related)...)
+		}
+	}
+	for _, relation := range meta.o2m[collection] {
+		items, _ := data[relation.OneField.String].([]interface{})
+		for _, item := range items {
+			if related, ok := item.(map[string]interface{}); ok {
+				deps = append(deps, dependencyKey(relation.ManyCollection, related[meta.primaryKey(relation.ManyCollection)]))
+				deps = append(deps, relatedDependencies(meta, relation.ManyCollection, related)...)
+			}
+		}
+	}
+	return deps
+}
+
+// normalizeNumbers converts the json.Numbers in decoded json to int64, or
+// float64 when they aren't whole numbers
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return value
+}
+
+// getItems calls GET /items/{collection} and decodes the data of the response into out
+func (d *directusSource) getItems(ctx context.Context, collection string, filter map[string]interface{}, fields string, sort string, limit int, out interface{}) error {
+	if !identifierPattern.MatchString(collection) {
+		return fmt.Errorf("invalid collection name %q", collection)
+	}
+
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("filter", string(filterJSON))
+	query.Set("fields", fields)
+	query.Set("limit", fmt.Sprint(limit))
+	if sort != "" {
+		query.Set("sort", sort)
+	}
+
+	return d.get(ctx, "/items/"+collection, query, out)
+}
+
+// get calls the API at path and decodes the data of the response into out
+func (d *directusSource) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("directus %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("directus %s: %w", path, err)
+	}
+
+	// keep numbers as written, ids shouldn't turn into floats
+	decoder := json.NewDecoder(bytes.NewReader(response.Data))
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A Directus API with a published about page and a draft, serving the
+// responses keyed by collection
+func newTestDirectus(t *testing.T) (*directusSource, *[]*http.Request) {
+	t.Helper()
+
+	responses := map[string]string{
+		"/relations": `[
+			{"collection": "block_hero", "field": "image", "related_collection": "directus_files", "meta": {"one_field": null}},
+			{"collection": "block_cards_cards", "field": "block_cards_id", "related_collection": "block_cards", "meta": {"one_field": "cards", "junction_field": "card_id"}},
+			{"collection": "block_cards_cards", "field": "card_id", "related_collection": "card", "meta": {"one_field": null, "junction_field": "block_cards_id"}},
+			{"collection": "page_blocks", "field": "item", "related_collection": null, "meta": {"one_field": null}}
+		]`,
+		"/fields": `[
+			{"collection": "block_hero", "field": "id", "schema": {"is_primary_key": true}},
+			{"collection": "block_hero", "field": "image", "schema": {"is_primary_key": false}},
+			{"collection": "block_cards", "field": "id", "schema": {"is_primary_key": true}},
+			{"collection": "block_cards_cards", "field": "id", "schema": {"is_primary_key": true}},
+			{"collection": "card", "field": "code", "schema": {"is_primary_key": true}},
+			{"collection": "directus_files", "field": "id", "schema": {"is_primary_key": true}},
+			{"collection": "page", "field": "cards", "schema": null}
+		]`,
+		"/items/page": `[{"id": 1, "uri": "about", "title": "About", "status": "published", "template": null}]`,
+		"/items/page_blocks": `[
+			{"id": 10, "collection": "block_hero", "item": "7d0c3f0e-5b8a-4f7e-9d4c-2a1b3c4d5e6f", "page_id": 1},
+			{"id": 11, "collection": "block_cards", "item": 2, "page_id": 1}
+		]`,
+		"/items/block_hero": `[{
+			"id": "7d0c3f0e-5b8a-4f7e-9d4c-2a1b3c4d5e6f",
+			"headline": "Hello",
+			"columns": 3,
+			"ratio": 1.5,
+			"image": {"id": "0b9a6c1e-aaaa-bbbb-cccc-000000000001", "width": 1200}
+		}]`,
+		"/items/block_cards": `[{
+			"id": 2,
+			"cards": [
+				{"id": 5, "block_cards_id": 2, "card_id": {"code": "intro", "title": "Intro"}},
+				{"id": 6, "block_cards_id": 2, "card_id": {"code": "team", "title": "Team"}}
+			]
+		}]`,
+	}
+
+	requests := []*http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, `{"errors": [{"message": "forbidden"}]}`, http.StatusForbidden)
+			return
+		}
+		data, found := responses[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": ` + data + `}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return newDirectusSource(server.URL+"/", "token", server.Client()), &requests
+}
+
+func TestDirectusPage(t *testing.T) {
+	source, _ := newTestDirectus(t)
+
+	page, err := source.GetPageByURI(context.Background(), "about")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.ID != 1 || page.Title != "About" || page.Uri.String != "about" {
+		t.Errorf("page = %+v", page)
+	}
+	if len(page.Blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(page.Blocks))
+	}
+
+	hero := page.Blocks[0]
+	if hero.Item != "7d0c3f0e-5b8a-4f7e-9d4c-2a1b3c4d5e6f" || hero.Data["headline"] != "Hello" {
+		t.Errorf("hero = %+v", hero)
+	}
+	// numbers decode like the database backend returns them
+	if hero.Data["columns"] != int64(3) || hero.Data["ratio"] != 1.5 {
+		t.Errorf("numbers = %#v, %#v, want int64 and float64", hero.Data["columns"], hero.Data["ratio"])
+	}
+	if image := hero.Data["image"].(map[string]interface{}); image["width"] != int64(1200) {
+		t.Errorf("nested number = %#v, want int64", image["width"])
+	}
+	if want := []string{"directus_files:0b9a6c1e-aaaa-bbbb-cccc-000000000001"}; !reflect.DeepEqual(hero.Dependencies, want) {
+		t.Errorf("hero dependencies = %v, want %v", hero.Dependencies, want)
+	}
+
+	cards := page.Blocks[1]
+	if cards.Item != "2" {
+		t.Errorf("cards item = %q, want 2", cards.Item)
+	}
+	for _, dep := range []string{"block_cards_cards:5", "block_cards_cards:6", "card:intro", "card:team"} {
+		if !slices.Contains(cards.Dependencies, dep) {
+			t.Errorf("cards dependencies %v are missing %s", cards.Dependencies, dep)
+		}
+	}
+
+	// the page is found through its dependencies when a related item changes
+	if !slices.Contains(page.dependencies(), "card:team") {
+		t.Error("page dependencies don't include the related items")
+	}
+}
+
+func TestDirectusBlockOnlyFromPublishedPages(t *testing.T) {
+	source, requests := newTestDirectus(t)
+
+	if _, err := source.GetBlock(context.Background(), 1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	var filter map[string]interface{}
+	for _, r := range *requests {
+		if r.URL.Path == "/items/page_blocks" {
+			json.Unmarshal([]byte(r.URL.Query().Get("filter")), &filter)
+		}
+	}
+	want := map[string]interface{}{
+		"id":     map[string]interface{}{"_eq": float64(1)},
+		"status": map[string]interface{}{"_eq": "published"},
+	}
+	if !reflect.DeepEqual(filter["page_id"], want) {
+		t.Errorf("page_id filter = %v, want %v", filter["page_id"], want)
+	}
+}
+
+func TestDirectusErrors(t *testing.T) {
+	source, _ := newTestDirectus(t)
+	source.token = "wrong"
+
+	if _, err := source.GetPageByURI(context.Background(), "about"); err == nil {
+		t.Error("expected the forbidden response to fail the page")
+	}
+}
+
+func TestDirectusKey(t *testing.T) {
+	for data, want := range map[string]directusKey{
+		`12`:                                     "12",
+		`"12"`:                                   "12",
+		`"7d0c3f0e-5b8a-4f7e-9d4c-2a1b3c4d5e6f"`: "7d0c3f0e-5b8a-4f7e-9d4c-2a1b3c4d5e6f",
+		`null`:                                   "",
+	} {
+		var key directusKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil || key != want {
+			t.Errorf("unmarshal %s = %q, %v, want %q", data, key, err, want)
+		}
+	}
+}
+
+// A card added to a block only names the block in the junction row, the page
+// using the block must still be invalidated
+func TestDirectusWebhookInvalidatesParents(t *testing.T) {
+	source, _ := newTestDirectus(t)
+	defer func(previousContent ContentSource, previousCache *PageCache, secret string) {
+		content, pageCache, config.WebhookSecret = previousContent, previousCache, secret
+	}(content, pageCache, config.WebhookSecret)
+	content = source
+	// bound to the source, the refresh after the webhook outlives the test
+	pageCache = newPageCache(testPageCacheConfig(), func(uri string) (Page, error) {
+		return source.GetPageByURI(context.Background(), uri)
+	})
+	config.WebhookSecret = "s3cret"
+
+	if _, err := pageCache.get("about"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"event": "items.create", "collection": "block_cards_cards", "key": 7, "payload": {"block_cards_id": 2, "card_id": "contact"}}`
+	r := httptest.NewRequest(http.MethodPost, WebhookRoute, strings.NewReader(body))
+	r.Header.Set("X-Webhook-Secret", "s3cret")
+	w := httptest.NewRecorder()
+	webhookRouteHandler(w, r)
+
+	var response struct {
+		Invalidated []string `json:"invalidated"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || !reflect.DeepEqual(response.Invalidated, []string{"about"}) {
+		t.Errorf("status %d, invalidated %v, want [about]", w.Code, response.Invalidated)
+	}
+}
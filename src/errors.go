@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Error details shown by the development overlay
+type TemplateError struct {
+	Template string
+	File     string
+	Line     int
+	Message  string
+	Source   []SourceLine
+}
+
+type SourceLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+// serverError responds with a 500 page. In development an overlay with the
+// failing template, line and error is shown instead. If the 500 template itself
+// fails to render, a plain text response is sent.
+func serverError(w http.ResponseWriter, r *http.Request, templateName string, err error) {
+	log.Printf("Error rendering template %q: %v", templateName, err)
+
+	if config.isDevelopment() {
+		if overlayErr := renderErrorOverlay(w, templateName, err); overlayErr == nil {
+			return
+		}
+	}
+
+	tmpl, tmplErr := templates.get(r, "500")
+	if tmplErr == nil {
+		data := map[string]interface{}{
+			"Env":     config.Env,
+			"Version": getVersionHash(),
+			"Seo": Seo{
+				Title:       "500 - Internal server error",
+				Description: "Something went wrong...",
+			},
+		}
+
+		hx := getHtmxRequest(r).retargetError(w)
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if tmplErr = tmpl.ExecuteTemplate(buf, hx.templateName(tmpl), data); tmplErr == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(buf.Bytes())
+			return
+		}
+	}
+
+	log.Printf("Error rendering 500 template: %v", tmplErr)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "500 - Internal server error", http.StatusInternalServerError)
+}
+
+func renderErrorOverlay(w http.ResponseWriter, templateName string, err error) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := errorOverlayTemplate.Execute(buf, newTemplateError(templateName, err)); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusInternalServerError)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// matches the "template: name:line:" prefix of parse and exec errors
+var templateErrorPattern = regexp.MustCompile(`template: ([^:\s]+):(\d+):`)
+
+func newTemplateError(templateName string, err error) TemplateError {
+	templateError := TemplateError{
+		Template: templateName,
+		Message:  err.Error(),
+	}
+
+	var escapeErr *template.Error
+	if errors.As(err, &escapeErr) && escapeErr.Name != "" {
+		templateError.File = escapeErr.Name
+		templateError.Line = escapeErr.Line
+	} else if match := templateErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+		templateError.File = match[1]
+		templateError.Line, _ = strconv.Atoi(match[2])
+	}
+
+	var pathErr *fs.PathError
+	if templateError.File == "" && errors.As(err, &pathErr) {
+		templateError.File = pathErr.Path
+	}
+
+	if templateError.File != "" && templateError.Line > 0 {
+		templateError.Source = readSourceLines(templateError.File, templateError.Line, 3)
+	}
+
+	return templateError
+}
+
+// Find the file the template was parsed from and return the lines around the
+// failing one
+func readSourceLines(fileName string, line int, context int) []SourceLine {
+	path := fileName
+	if parsed, ok := templateFiles.Load(filepath.Base(fileName)); ok {
+		path = parsed.(string)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	lines := strings.Split(string(content), "\n")
+	sourceLines := []SourceLine{}
+	for i := max(line-context, 1); i <= min(line+context, len(lines)); i++ {
+		sourceLines = append(sourceLines, SourceLine{
+			Number:  i,
+			Text:    lines[i-1],
+			Current: i == line,
+		})
+	}
+	return sourceLines
+}
+
+// The overlay is self contained so it still renders when the template files are broken
+var errorOverlayTemplate = template.Must(template.New("error-overlay").Parse(`<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="UTF-8" />
+    <title>Template error - {{ .Template }}</title>
+    <style>
+      body { margin: 0; background: #1a1a1a; color: #e5e5e5; font-family: ui-monospace, Menlo, monospace; }
+      main { max-width: 960px; margin: 0 auto; padding: 48px 24px; }
+      h1 { color: #ff5555; font-size: 20px; }
+      pre { background: #111; padding: 16px; overflow-x: auto; white-space: pre-wrap; }
+      .meta { color: #a3a3a3; }
+      .current { background: #5c1f1f; display: block; }
+    </style>
+  </head>
+  <body>
+    <main>
+      <h1>Error rendering template "{{ .Template }}"</h1>
+      {{ if .File }}<p class="meta">{{ .File }}{{ if .Line }}:{{ .Line }}{{ end }}</p>{{ end }}
+      <pre>{{ .Message }}</pre>
+      {{ if .Source }}
+      <pre>{{ range .Source }}<span{{ if .Current }} class="current"{{ end }}>{{ printf "%4d" .Number }} | {{ .Text }}</span>
+{{ end }}</pre>
+      {{ end }}
+    </main>
+  </body>
+</html>
+`))
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Optimized image urls as written by getImageProps, with the & escaped or not
+var imageURLPattern = regexp.MustCompile(`/_image/image\.(\w+)\?url=([^&"'\s,]+)&(?:amp;)?width=(\d+)(?:&(?:amp;)?quality=(\d+))?`)
+
+// Written to the export directory, only a directory with it is emptied by
+// the next export
+const exportMarker = ".cookie-export"
+
+// Set while exporting. Static files can't negotiate the image format, so
+// image urls name theirs.
+var exporting bool
+
+// exportSite renders every published page into dir as <uri>/index.html, next
+// to the generated assets and static files, so the site can be deployed to a
+// CDN without the Go server or a database. Images are optimized ahead of time
+// and their /_image urls rewritten to the static files.
+func exportSite(dir string) error {
+	start := time.Now()
+
+	// fail before the slow build when the directory can't be used
+	if err := checkExportDir(dir); err != nil {
+		return err
+	}
+
+	// the version busts browser caches of the exported assets
+	if version == "" {
+		version = strconv.FormatInt(start.Unix(), 10)
+	}
+	exporting = true
+
+	if err := initContentSource(); err != nil {
+		return err
+	}
+	if err := blockRegistry.discover(); err != nil {
+		return err
+	}
+
+	if err := bundleAssets(); err != nil {
+		return err
+	}
+
+	if err := prepareExportDir(dir); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	pages, err := content.ListPages(ctx)
+	if err != nil {
+		return err
+	}
+
+	images := make(map[string]string)
+	for _, listed := range pages {
+		uri := pageURI(listed)
+
+		page, err := content.GetPageByURI(ctx, uri)
+		if err != nil {
+			return fmt.Errorf("%s: %w", uri, err)
+		}
+
+		// there is no server to load lazy blocks from
+		for i := range page.Blocks {
+			page.Blocks[i].Lazy = false
+		}
+
+		html, err := exportRender(uri, http.StatusOK, func(w http.ResponseWriter, r *http.Request) {
+			pageFound(page, w, r)
+		})
+		if err != nil {
+			return err
+		}
+
+		html, err = exportImages(dir, html, images)
+		if err != nil {
+			return fmt.Errorf("%s: %w", uri, err)
+		}
+
+		if err := writeExportFile(filepath.Join(dir, exportPath(uri)), html); err != nil {
+			return err
+		}
+		exportLogger("exported " + uri)
+	}
+
+	html, err := exportRender("/404", http.StatusNotFound, notFound)
+	if err != nil {
+		return err
+	}
+	if err := writeExportFile(filepath.Join(dir, "404.html"), html); err != nil {
+		return err
+	}
+
+	assets := map[string]string{
+		".generated/css":               "css",
+		".generated/esbuild/templates": "bundle",
+		"static":                       "static",
+	}
+	for from, to := range assets {
+		if err := copyDir(from, filepath.Join(dir, to)); err != nil {
+			return err
+		}
+	}
+	for _, file := range []string{"robots.txt", "favicon.ico"} {
+		if err := copyFile(filepath.Join("static", file), filepath.Join(dir, file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	exportLogger(fmt.Sprintf("exported %d pages and %d images to %s in %0.2fms", len(pages), len(images), dir, time.Since(start).Seconds()*1000))
+	return nil
+}
+
+// checkExportDir refuses directories the export must not empty: the project
+// itself or one of its parents, and directories with files that weren't
+// written by an earlier export
+func checkExportDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("invalid export directory %q", dir)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(abs, root); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("can't export to %s, it contains the project", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, exportMarker)); err != nil {
+		return fmt.Errorf("can't export to %s, it isn't empty and has no %s from an earlier export", dir, exportMarker)
+	}
+	return nil
+}
+
+// prepareExportDir empties the export directory, keeping the directory
+// itself, and marks it as an export
+func prepareExportDir(dir string) error {
+	if err := checkExportDir(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(filepath.Join(dir, exportMarker), []byte("Written by the export command, the directory is emptied by the next export.\n"), 0644)
+}
+
+// Render a page through the regular handlers and return its html
+func exportRender(uri string, status int, handler http.HandlerFunc) (string, error) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, uri, nil))
+	if rec.Code != status {
+		return "", fmt.Errorf("%s: rendered with status %d", uri, rec.Code)
+	}
+	return rec.Body.String(), nil
+}
+
+// Optimize every image in the html and point its urls at the static copies.
+// images maps the optimized files that were already copied to their url.
+func exportImages(dir string, html string, images map[string]string) (string, error) {
+	var exportErr error
+	html = imageURLPattern.ReplaceAllStringFunc(html, func(match string) string {
+		if exportErr != nil {
+			return match
+		}
+
+		parts := imageURLPattern.FindStringSubmatch(match)
+		imageUrl, err := url.QueryUnescape(parts[2])
+		if err != nil {
+			exportErr = err
+			return match
+		}
+		width, _ := strconv.Atoi(parts[3])
+		quality, _ := strconv.Atoi(parts[4])
+
+		imagePath, err := optimizeImage(imageUrl, width, ImageFormat(parts[1]), quality)
+		if err != nil {
+			exportErr = fmt.Errorf("image %s: %w", imageUrl, err)
+			return match
+		}
+
+		if staticUrl, ok := images[imagePath]; ok {
+			return staticUrl
+		}
+
+		rel := strings.TrimPrefix(filepath.ToSlash(imagePath), ".generated/")
+		if err := copyFile(imagePath, filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			exportErr = err
+			return match
+		}
+		images[imagePath] = "/" + rel
+		return "/" + rel
+	})
+	return html, exportErr
+}
+
+// / -> index.html, /about -> about/index.html
+func exportPath(uri string) string {
+	clean := strings.Trim(path.Clean("/"+uri), "/")
+	return filepath.Join(filepath.FromSlash(clean), "index.html")
+}
+
+func writeExportFile(file string, html string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(html), 0644)
+}
+
+// Copy a directory recursively, a missing source is skipped
+func copyDir(from string, to string) error {
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		exportLogger(color.YellowString("skipped %s, it doesn't exist", from))
+		return nil
+	}
+
+	return filepath.WalkDir(from, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, file)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(to, rel), 0755)
+		}
+		return copyFile(file, filepath.Join(to, rel))
+	})
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
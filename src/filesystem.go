@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yuin/goldmark"
+	"gopkg.in/yaml.v3"
+)
+
+// fsSource reads pages from Markdown files in a content directory, so sites can
+// run without a database. Each page is a .md file with YAML (---) or TOML (+++)
+// front matter:
+//
+//	---
+//	uri: /about          # defaults to the path, content/about.md -> /about
+//	title: About us
+//	template: default
+//	status: published    # pages with another status are not served
+//	seo:
+//	  title: About us
+//	  description: Who we are
+//	blocks:
+//	  - collection: block_hero
+//	    headline: Hello
+//	    markdown: "Every block can set its **content** in Markdown"
+//	  - collection: block_text
+//	    markdown: "Rendered to HTML in **content**"
+//	---
+//	The Markdown body is rendered as a final block_text block.
+//
+// The parsed pages are kept until reset is called, by the dev watcher when a
+// content file changes.
+type fsSource struct {
+	dir string
+
+	mu    sync.Mutex
+	pages []Page // nil until loaded
+}
+
+type frontMatter struct {
+	ID       int    `yaml:"id" toml:"id"`
+	Uri      string `yaml:"uri" toml:"uri"`
+	Title    string `yaml:"title" toml:"title"`
+	Template string `yaml:"template" toml:"template"`
+	Status   string `yaml:"status" toml:"status"`
+	Seo      struct {
+		Title       string `yaml:"title" toml:"title"`
+		Description string `yaml:"description" toml:"description"`
+	} `yaml:"seo" toml:"seo"`
+	Blocks []map[string]interface{} `yaml:"blocks" toml:"blocks"`
+}
+
+func newFsSource(dir string) *fsSource {
+	return &fsSource{dir: dir}
+}
+
+func (s *fsSource) GetPageByURI(ctx context.Context, uri string) (Page, error) {
+	pages, err := s.loadPages()
+	if err != nil {
+		return Page{}, err
+	}
+
+	for _, page := range pages {
+		if page.Status == "published" && pageURI(page) == uri {
+			return page, nil
+		}
+	}
+	return Page{}, errPageNotFound
+}
+
+// Files have no revisions, so drafts are shown as saved
+func (s *fsSource) GetPreviewPage(ctx context.Context, uri string, revision int) (Page, error) {
+	pages, err := s.loadPages()
+	if err != nil {
+		return Page{}, err
+	}
+
+	for _, page := range pages {
+		if pageURI(page) == uri {
+			page.Preview = true
+			return page, nil
+		}
+	}
+	return Page{}, errPageNotFound
+}
+
+func (s *fsSource) ListPages(ctx context.Context) ([]Page, error) {
+	pages, err := s.loadPages()
+	if err != nil {
+		return nil, err
+	}
+
+	published := []Page{}
+	for _, page := range pages {
+		if page.Status == "published" {
+			page.Blocks = nil
+			published = append(published, page)
+		}
+	}
+	return published, nil
+}
+
+func (s *fsSource) GetBlock(ctx context.Context, pageID int, blockID int) (Block, error) {
+	pages, err := s.loadPages()
+	if err != nil {
+		return Block{}, err
+	}
+
+	for _, page := range pages {
+		if page.ID != pageID || page.Status != "published" {
+			continue
+		}
+		for _, block := range page.Blocks {
+			if block.ID == blockID {
+				return block, nil
+			}
+		}
+	}
+	return Block{}, errBlockNotFound
+}
+
+// Drop the parsed pages, they're read again on the next lookup
+func (s *fsSource) reset() {
+	s.mu.Lock()
+	s.pages = nil
+	s.mu.Unlock()
+}
+
+// The pages in the content directory, parsed on first use
+func (s *fsSource) loadPages() ([]Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pages != nil {
+		return s.pages, nil
+	}
+	pages, err := s.readPages()
+	if err != nil {
+		return nil, err
+	}
+	s.pages = pages
+	return pages, nil
+}
+
+// Read every page in the content directory. Pages without an id in their front
+// matter get one derived from their path, so adding files doesn't change the
+// ids of the others and their /_block urls.
+func (s *fsSource) readPages() ([]Page, error) {
+	paths := []string{}
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(path) == ".md" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	pages := []Page{}
+	ids := make(map[int]string)
+	for _, path := range paths {
+		page, err := s.loadPage(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if other, found := ids[page.ID]; found {
+			return nil, fmt.Errorf("%s: id %d is already used by %s, set another id in its front matter", path, page.ID, other)
+		}
+		ids[page.ID] = path
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+// The id of a page without one in its front matter, a hash of its path
+// relative to the content directory
+func pageIDFromPath(dir string, path string) int {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filepath.ToSlash(rel)))
+	// positive and not 0, which means no id
+	id := int(h.Sum32() & 0x7fffffff)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+func (s *fsSource) loadPage(path string) (Page, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return Page{}, err
+	}
+
+	matter, body, err := parseFrontMatter(source)
+	if err != nil {
+		return Page{}, err
+	}
+
+	page := Page{
+		ID:       matter.ID,
+		Status:   matter.Status,
+		Title:    matter.Title,
+		Template: matter.Template,
+		Seo: Seo{
+			Title:       matter.Seo.Title,
+			Description: matter.Seo.Description,
+		},
+	}
+	if page.ID == 0 {
+		page.ID = pageIDFromPath(s.dir, path)
+	}
+	if page.Status == "" {
+		page.Status = "published"
+	}
+
+	uri := matter.Uri
+	if uri == "" {
+		uri = uriFromPath(s.dir, path)
+	}
+	if uri != "/" {
+		page.Uri.String, page.Uri.Valid = uri, true
+	}
+
+	blocksData := matter.Blocks
+	if body := bytes.TrimSpace(body); len(body) > 0 {
+		blocksData = append(blocksData, map[string]interface{}{
+			"collection": "block_text",
+			"markdown":   string(body),
+		})
+	}
+
+	for i, data := range blocksData {
+		block, err := fsBlock(page.ID, i+1, data)
+		if err != nil {
+			return Page{}, fmt.Errorf("block %d: %w", i+1, err)
+		}
+		page.Blocks = append(page.Blocks, block)
+	}
+
+	return page, nil
+}
+
+// Build a block from its front matter data, rendering "markdown" into "content"
+func fsBlock(pageID int, blockID int, data map[string]interface{}) (Block, error) {
+	collection, _ := data["collection"].(string)
+	if collection == "" {
+		return Block{}, errors.New("missing collection")
+	}
+
+	blockData := make(map[string]interface{})
+	for key, value := range data {
+		if key != "collection" {
+			blockData[key] = value
+		}
+	}
+	blockData["id"] = blockID
+
+	if markdown, ok := blockData["markdown"].(string); ok {
+		var html bytes.Buffer
+		if err := goldmark.Convert([]byte(markdown), &html); err != nil {
+			return Block{}, err
+		}
+		blockData["content"] = html.String()
+		delete(blockData, "markdown")
+	}
+
+	return Block{
+		ID:         blockID,
+		PageID:     pageID,
+		Collection: collection,
+		Item:       fmt.Sprint(blockID),
+		Data:       blockData,
+		Lazy:       isLazyBlock(blockData),
+	}, nil
+}
+
+// Split the YAML (---) or TOML (+++) front matter from the Markdown body
+func parseFrontMatter(source []byte) (frontMatter, []byte, error) {
+	var matter frontMatter
+	source = bytes.ReplaceAll(source, []byte("\r\n"), []byte("\n"))
+
+	for _, delimiter := range []string{"---", "+++"} {
+		if !bytes.HasPrefix(source, []byte(delimiter+"\n")) {
+			continue
+		}
+
+		rest := source[len(delimiter)+1:]
+		end := bytes.Index(rest, []byte("\n"+delimiter))
+		if end < 0 {
+			return matter, nil, fmt.Errorf("unterminated front matter, expected a closing %s", delimiter)
+		}
+		header, body := rest[:end], rest[end+len(delimiter)+1:]
+
+		var err error
+		if delimiter == "---" {
+			err = yaml.Unmarshal(header, &matter)
+		} else {
+			err = toml.Unmarshal(header, &matter)
+		}
+		return matter, body, err
+	}
+
+	// no front matter, just Markdown
+	return matter, source, nil
+}
+
+// content/index.md -> /, content/about/team.md -> /about/team
+func uriFromPath(dir string, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+	rel = strings.TrimSuffix(filepath.ToSlash(rel), ".md")
+	if rel == "index" {
+		return "/"
+	}
+	return "/" + strings.TrimSuffix(rel, "/index")
+}
+
+// The uri a page is served at, the home page has an empty uri
+func pageURI(page Page) string {
+	if !page.Uri.Valid || page.Uri.String == "" {
+		return "/"
+	}
+	return page.Uri.String
+}
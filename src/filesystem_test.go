@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testContentDir = "testdata/content"
+
+func TestFsPages(t *testing.T) {
+	source := newFsSource(testContentDir)
+	ctx := context.Background()
+
+	home, err := source.GetPageByURI(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if home.Title != "Home" || home.Status != "published" || home.Seo.Description != "The home page" {
+		t.Errorf("home = %+v", home)
+	}
+	if len(home.Blocks) != 3 {
+		t.Fatalf("got %d blocks, want the 2 from the front matter and the body", len(home.Blocks))
+	}
+	if block := home.Blocks[1]; !block.Lazy || !strings.Contains(block.Data["content"].(string), "<strong>bold</strong>") {
+		t.Errorf("markdown block = %+v", block)
+	}
+	if block := home.Blocks[2]; block.Collection != "block_text" || !strings.Contains(block.Data["content"].(string), "The body") {
+		t.Errorf("body block = %+v", block)
+	}
+
+	about, err := source.GetPageByURI(ctx, "/about")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if about.Title != "About" || about.Template != "default" || about.Blocks[0].Data["headline"] != "About us" {
+		t.Errorf("toml page = %+v", about)
+	}
+
+	team, err := source.GetPageByURI(ctx, "/people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if team.ID != 42 {
+		t.Errorf("front matter id = %d, want 42", team.ID)
+	}
+}
+
+func TestFsDrafts(t *testing.T) {
+	source := newFsSource(testContentDir)
+	ctx := context.Background()
+
+	if _, err := source.GetPageByURI(ctx, "/blog/draft"); !errors.Is(err, errPageNotFound) {
+		t.Errorf("draft error = %v, want errPageNotFound", err)
+	}
+
+	draft, err := source.GetPreviewPage(ctx, "/blog/draft", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !draft.Preview || draft.Status != "draft" {
+		t.Errorf("preview = %+v", draft)
+	}
+
+	if _, err := source.GetBlock(ctx, draft.ID, draft.Blocks[0].ID); !errors.Is(err, errBlockNotFound) {
+		t.Errorf("block of a draft error = %v, want errBlockNotFound", err)
+	}
+
+	pages, err := source.ListPages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pages {
+		if page.Status != "published" || page.Blocks != nil {
+			t.Errorf("listed page = %+v", page)
+		}
+	}
+	if len(pages) != 3 {
+		t.Errorf("listed %d pages, want 3", len(pages))
+	}
+}
+
+func TestFsBlock(t *testing.T) {
+	source := newFsSource(testContentDir)
+	ctx := context.Background()
+
+	home, _ := source.GetPageByURI(ctx, "/")
+	block, err := source.GetBlock(ctx, home.ID, home.Blocks[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Data["headline"] != "Hello" {
+		t.Errorf("block = %+v", block)
+	}
+	if _, err := source.GetBlock(ctx, home.ID, 99); !errors.Is(err, errBlockNotFound) {
+		t.Errorf("missing block error = %v, want errBlockNotFound", err)
+	}
+}
+
+// Adding a page must not change the ids of the others, cached /_block urls use them
+func TestFsStableIDs(t *testing.T) {
+	dir := copyContent(t)
+	source := newFsSource(dir)
+	ctx := context.Background()
+
+	before, _ := source.GetPageByURI(ctx, "/about")
+
+	// sorts before every other file
+	writeContent(t, filepath.Join(dir, "aaa.md"), "---\ntitle: First\n---\n")
+	source.reset()
+
+	after, err := source.GetPageByURI(ctx, "/about")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ID != before.ID {
+		t.Errorf("id changed from %d to %d after adding a page", before.ID, after.ID)
+	}
+	if first, _ := source.GetPageByURI(ctx, "/aaa"); first.ID == 0 || first.ID == after.ID {
+		t.Errorf("new page id = %d", first.ID)
+	}
+}
+
+func TestFsDuplicateIDs(t *testing.T) {
+	dir := copyContent(t)
+	writeContent(t, filepath.Join(dir, "other.md"), "---\nid: 42\n---\n")
+
+	if _, err := newFsSource(dir).ListPages(context.Background()); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("error = %v, want a duplicate id error", err)
+	}
+}
+
+// Pages are parsed once and read again after a reset
+func TestFsCachesUntilReset(t *testing.T) {
+	dir := copyContent(t)
+	source := newFsSource(dir)
+	ctx := context.Background()
+
+	source.GetPageByURI(ctx, "/people")
+	writeContent(t, filepath.Join(dir, "about", "team.md"), "---\nid: 42\ntitle: Our team\nuri: /people\n---\n")
+
+	if page, _ := source.GetPageByURI(ctx, "/people"); page.Title != "Team" {
+		t.Errorf("title before the reset = %q, want the cached Team", page.Title)
+	}
+	source.reset()
+	if page, _ := source.GetPageByURI(ctx, "/people"); page.Title != "Our team" {
+		t.Errorf("title after the reset = %q, want Our team", page.Title)
+	}
+}
+
+func TestUriFromPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"content/index.md":       "/",
+		"content/about.md":       "/about",
+		"content/about/index.md": "/about",
+		"content/about/team.md":  "/about/team",
+	} {
+		if got := uriFromPath("content", path); got != want {
+			t.Errorf("uriFromPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// A copy of the test content that tests can change
+func copyContent(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := filepath.WalkDir(testContentDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(testContentDir, path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		writeContent(t, filepath.Join(dir, rel), string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeContent(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Request headers sent by htmx, see https://htmx.org/reference/#request_headers
+type HtmxRequest struct {
+	Request        bool   // HX-Request, always true for requests made by htmx
+	Boosted        bool   // HX-Boosted, the request came from an element using hx-boost
+	Target         string // HX-Target, the id of the target element
+	Trigger        string // HX-Trigger, the id of the triggered element
+	CurrentURL     string // HX-Current-URL
+	HistoryRestore bool   // HX-History-Restore-Request, a full page is needed after a history cache miss
+}
+
+func getHtmxRequest(r *http.Request) HtmxRequest {
+	return HtmxRequest{
+		Request:        r.Header.Get("HX-Request") == "true",
+		Boosted:        r.Header.Get("HX-Boosted") == "true",
+		Target:         r.Header.Get("HX-Target"),
+		Trigger:        r.Header.Get("HX-Trigger"),
+		CurrentURL:     r.Header.Get("HX-Current-URL"),
+		HistoryRestore: r.Header.Get("HX-History-Restore-Request") == "true",
+	}
+}
+
+// Templates an htmx request may ask for by HX-Target. Anything else, like
+// "head" or a block template, was never meant to be served on its own.
+var htmxPartials = []string{"content", "blocks"}
+
+// Returns the name of the template to render for the request:
+//   - full page requests and history restores render the whole layout
+//   - boosted navigation renders the body (and title) without the head
+//   - other htmx requests render the partial named by HX-Target if it's
+//     allowed and the template set defines it, otherwise just the page content
+func (hx HtmxRequest) templateName(tmpl *template.Template) string {
+	switch {
+	case !hx.Request || hx.HistoryRestore:
+		return "layout.go.html"
+	case hx.Boosted:
+		return "boosted"
+	case tmpl.Lookup(hx.partial()) != nil:
+		return hx.partial()
+	default:
+		return "content"
+	}
+}
+
+// The allowed partial named by HX-Target, or content
+func (hx HtmxRequest) partial() string {
+	if slices.Contains(htmxPartials, hx.Target) {
+		return hx.Target
+	}
+	return "content"
+}
+
+// Identifies which render of a page the request gets, used to tell the ETags apart
+func (hx HtmxRequest) variant() string {
+	switch {
+	case !hx.Request || hx.HistoryRestore:
+		return ""
+	case hx.Boosted:
+		return "boosted"
+	default:
+		return "target:" + hx.partial()
+	}
+}
+
+// Error pages replace the whole page, the element an htmx request targets was
+// meant for part of a page that doesn't exist. Returns the request to render
+// the error page for, boosted renders the body.
+func (hx HtmxRequest) retargetError(w http.ResponseWriter) HtmxRequest {
+	if !hx.Request || hx.HistoryRestore {
+		return hx
+	}
+	hxRetarget(w, "body")
+	hxReswap(w, "innerHTML")
+	hx.Boosted = true
+	return hx
+}
+
+// The response varies by the htmx headers, so shared caches must key on them
+func setHtmxVary(w http.ResponseWriter) {
+	w.Header().Add("Vary", "HX-Request")
+	w.Header().Add("Vary", "HX-Boosted")
+	w.Header().Add("Vary", "HX-Target")
+}
+
+// Response headers understood by htmx, see https://htmx.org/reference/#response_headers
+
+// Pushes a new url into the browser history
+func hxPushUrl(w http.ResponseWriter, url string) {
+	w.Header().Set("HX-Push-Url", url)
+}
+
+// Replaces the current url in the browser location bar
+func hxReplaceUrl(w http.ResponseWriter, url string) {
+	w.Header().Set("HX-Replace-Url", url)
+}
+
+// Triggers client side events by name
+func hxTrigger(w http.ResponseWriter, events ...string) {
+	w.Header().Set("HX-Trigger", strings.Join(events, ", "))
+}
+
+// Triggers client side events with details, e.g. {"showMessage": "Saved"}
+func hxTriggerWithDetails(w http.ResponseWriter, events map[string]interface{}) error {
+	value, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Trigger", string(value))
+	return nil
+}
+
+// Swaps the response into a different element than the one that made the request
+func hxRetarget(w http.ResponseWriter, selector string) {
+	w.Header().Set("HX-Retarget", selector)
+}
+
+// Changes how the response is swapped, e.g. "outerHTML"
+func hxReswap(w http.ResponseWriter, swap string) {
+	w.Header().Set("HX-Reswap", swap)
+}
+
+// Does a client side redirect with a full page reload
+func hxRedirect(w http.ResponseWriter, url string) {
+	w.Header().Set("HX-Redirect", url)
+}
+
+// Reloads the whole page on the client
+func hxRefresh(w http.ResponseWriter) {
+	w.Header().Set("HX-Refresh", "true")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHtmxResponseHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	hxPushUrl(w, "/pushed")
+	hxReplaceUrl(w, "/replaced")
+	hxTrigger(w, "saved", "closed")
+	hxRetarget(w, "#errors")
+	hxReswap(w, "outerHTML")
+	hxRedirect(w, "/elsewhere")
+	hxRefresh(w)
+
+	for name, want := range map[string]string{
+		"HX-Push-Url":    "/pushed",
+		"HX-Replace-Url": "/replaced",
+		"HX-Trigger":     "saved, closed",
+		"HX-Retarget":    "#errors",
+		"HX-Reswap":      "outerHTML",
+		"HX-Redirect":    "/elsewhere",
+		"HX-Refresh":     "true",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	if err := hxTriggerWithDetails(w, map[string]interface{}{"showMessage": "Saved"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("HX-Trigger"); got != `{"showMessage":"Saved"}` {
+		t.Errorf("HX-Trigger = %q", got)
+	}
+	if err := hxTriggerWithDetails(w, map[string]interface{}{"bad": func() {}}); err == nil {
+		t.Error("expected an error for details that aren't json")
+	}
+}
+
+// A 404 for an htmx request replaces the body with the page, without the
+// document around it
+func TestNotFoundForHtmxRequests(t *testing.T) {
+	serveTestContent(t, "src/"+testContentDir)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		layout  bool
+	}{
+		{"full page", nil, true},
+		{"boosted", map[string]string{"HX-Request": "true", "HX-Boosted": "true"}, false},
+		{"partial", map[string]string{"HX-Request": "true", "HX-Target": "content"}, false},
+		{"history restore", map[string]string{"HX-Request": "true", "HX-History-Restore-Request": "true"}, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/not-a-page", nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		routeHandler(w, r)
+
+		body := w.Body.String()
+		if w.Code != http.StatusNotFound || !strings.Contains(body, "404") {
+			t.Fatalf("%s: status %d:\n%s", test.name, w.Code, body)
+		}
+		if layout := strings.Contains(body, "<html"); layout != test.layout {
+			t.Errorf("%s: rendered the layout = %v, want %v", test.name, layout, test.layout)
+		}
+		if retarget := w.Header().Get("HX-Retarget"); test.layout && retarget != "" || !test.layout && retarget != "body" {
+			t.Errorf("%s: HX-Retarget = %q", test.name, retarget)
+		}
+		if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "HX-Request") {
+			t.Errorf("%s: the 404 doesn't vary by HX-Request", test.name)
+		}
+	}
+}
+
+func TestPreviewRedirectsForHtmxRequests(t *testing.T) {
+	tests := []struct {
+		url      string
+		htmx     bool
+		status   int
+		header   string
+		location string
+	}{
+		{PreviewRoute + "/exit?uri=/about", false, http.StatusTemporaryRedirect, "Location", "/about"},
+		{PreviewRoute + "/exit?uri=/about", true, http.StatusOK, "HX-Redirect", "/about"},
+		{PreviewRoute + "/exit", true, http.StatusOK, "HX-Refresh", "true"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		if test.htmx {
+			r.Header.Set("HX-Request", "true")
+		}
+		w := httptest.NewRecorder()
+		previewExitRouteHandler(w, r)
+
+		if w.Code != test.status || w.Header().Get(test.header) != test.location {
+			t.Errorf("%s (htmx %v): status %d, %s = %q", test.url, test.htmx, w.Code, test.header, w.Header().Get(test.header))
+		}
+		if !strings.Contains(w.Header().Get("Set-Cookie"), previewCookieName+"=;") {
+			t.Errorf("%s: the preview cookie wasn't cleared", test.url)
+		}
+	}
+}
@@ -1,48 +1,89 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"html/template"
 	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
-	"github.com/fatih/color"
+	"github.com/gen2brain/webp"
 )
 
 const ImageBaseRoute = "/_image"
 
+// AVIF isn't supported, its encoders need cgo or are too slow to run on
+// request. WebP is encoded by libwebp compiled to wasm, lossy at the image
+// quality, and lossless for graphics (png and gif sources).
 type ImageFormat string
 
 const (
 	FormatWebP ImageFormat = "webp"
+	FormatJPEG ImageFormat = "jpeg"
 	FormatPNG  ImageFormat = "png"
 )
 
-func getImageProps(headers http.Header, imageUrl string, options ...string) template.HTMLAttr {
+// Returns the attributes of an optimized <img>: src, srcset, sizes and the
+// given options. Without fixedFormat the image urls have no format and
+// /_image picks one by the Accept header of the image request. Pages in
+// shared caches and the static export can't depend on the browser, their
+// urls ask for jpeg. getImage adds a webp <source> that works on every page.
+func getImageProps(fixedFormat bool, imageUrl string, options ...string) template.HTMLAttr {
+	var format ImageFormat
+	if fixedFormat {
+		format = FormatJPEG
+	}
+	attrs, _ := imageAttrs(imageUrl, format, options)
+	return template.HTMLAttr(attrs)
+}
+
+// Returns an optimized image element: a <picture> with a webp <source> and a
+// jpeg (or png) <img> fallback. The formats are in the urls, so the html is
+// the same for every browser and can be stored by shared caches.
+func getImage(imageUrl string, options ...string) template.HTML {
+	attrs, sizes := imageAttrs(imageUrl, FormatJPEG, options)
+	if !config.Images.WebP {
+		return template.HTML("<img " + attrs + "/>")
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>")
+	fmt.Fprintf(&b, `<source type="image/webp" srcset="%s" sizes="%s" />`,
+		template.HTMLEscapeString(generateSrcset(imageUrl, config.Images.MaxWidth, FormatWebP, imageQuality(options))),
+		template.HTMLEscapeString(sizes))
+	b.WriteString("<img " + attrs + "/>")
+	b.WriteString("</picture>")
+	return template.HTML(b.String())
+}
+
+// The escaped attributes of an optimized image and its sizes
+func imageAttrs(imageUrl string, format ImageFormat, options []string) (string, string) {
 	attrs := make(map[string]string)
 	order := []string{"src"} // Start with src as the first key
-	maxWidth := 1920         // Default maxWidth
+	maxWidth := config.Images.MaxWidth
+	quality := imageQuality(options)
 	// customSrcsetProvided := false
 	customSizesProvided := false
 
-	imageFormat := getSupportedImageFormat(headers)
-
-	attrs["src"] = fmt.Sprintf(ImageBaseRoute+"/image.%s?url=%s&width=%d", imageFormat, url.QueryEscape(imageUrl), maxWidth)
-
 	for _, option := range options {
 		parts := strings.Split(option, "=")
 		if len(parts) == 2 {
 			key := parts[0]
 			value := parts[1]
 			// Add key to order if it's a new key and not srcset or sizes
-			if _, exists := attrs[key]; !exists && key != "srcset" && key != "sizes" {
+			if _, exists := attrs[key]; !exists && key != "srcset" && key != "sizes" && key != "quality" {
 				order = append(order, key)
 			}
 
@@ -65,6 +106,9 @@ func getImageProps(headers http.Header, imageUrl string, options ...string) temp
 			// 	maxWidth = 1920 // Reset to default if conversion fails
 			// }
 
+			case "quality":
+				// read by imageQuality
+
 			case "sizes":
 				customSizesProvided = true
 				attrs["sizes"] = value // Use the provided custom sizes
@@ -80,7 +124,8 @@ func getImageProps(headers http.Header, imageUrl string, options ...string) temp
 		order = append(order, "sizes") // Add sizes to the order
 	}
 
-	attrs["srcset"] = generateSrcset(imageUrl, maxWidth, imageFormat)
+	attrs["src"] = optimizedImageURL(imageUrl, maxWidth, format, quality)
+	attrs["srcset"] = generateSrcset(imageUrl, maxWidth, format, quality)
 	order = append(order, "srcset") // Add srcset to the order
 	order = append(order, "style")
 	attrs["decoding"] = "async"
@@ -89,110 +134,218 @@ func getImageProps(headers http.Header, imageUrl string, options ...string) temp
 	var b strings.Builder
 	for _, key := range order {
 		if value, ok := attrs[key]; ok {
-			b.WriteString(fmt.Sprintf(`%s="%s" `, key, value))
+			b.WriteString(fmt.Sprintf(`%s="%s" `, key, template.HTMLEscapeString(value)))
 		}
 	}
+	return b.String(), attrs["sizes"]
+}
 
-	return template.HTMLAttr(b.String())
+// The quality of an image from its "quality=60" option, 0 for the default
+func imageQuality(options []string) int {
+	quality := 0
+	for _, option := range options {
+		if value, found := strings.CutPrefix(option, "quality="); found {
+			quality, _ = strconv.Atoi(value)
+		}
+	}
+	if quality == 0 {
+		return 0
+	}
+	return normalizeQuality(quality)
 }
 
-func generateSrcset(imageUrl string, maxWidth int, format ImageFormat) string {
+// Qualities are rounded to steps of 10, so clients can't fill the disk with
+// a variant per quality. 0 and the configured quality are left as they are.
+func normalizeQuality(quality int) int {
+	if quality == 0 || quality == config.Images.Quality {
+		return quality
+	}
+	quality = (quality + 5) / 10 * 10
+	return min(max(quality, 10), 100)
+}
+
+// Whether width is one of the widths image urls are generated with
+func isImageWidth(width int) bool {
+	return slices.Contains(generateWidths(config.Images.MaxWidth), width)
+}
+
+func generateSrcset(imageUrl string, maxWidth int, format ImageFormat, quality int) string {
 	widths := generateWidths(maxWidth)
 	srcsetValues := make([]string, len(widths))
 	for i, width := range widths {
-		optimizedImageUrl := fmt.Sprintf(ImageBaseRoute+"/image.%s?url=%s&width=%d", format, url.QueryEscape(imageUrl), width)
-		srcsetValues[i] = fmt.Sprintf("%s %dw", optimizedImageUrl, width)
+		srcsetValues[i] = fmt.Sprintf("%s %dw", optimizedImageURL(imageUrl, width, format, quality), width)
 	}
 	return strings.Join(srcsetValues, ", ")
 }
 
+// /_image/image.webp?url=...&width=640, without a format it's negotiated
+func optimizedImageURL(imageUrl string, width int, format ImageFormat, quality int) string {
+	name := "image"
+	if format != "" {
+		name += "." + string(format)
+	}
+	optimizedImageUrl := fmt.Sprintf(ImageBaseRoute+"/%s?url=%s&width=%d", name, url.QueryEscape(imageUrl), width)
+	if quality > 0 {
+		optimizedImageUrl += fmt.Sprintf("&quality=%d", quality)
+	}
+	return optimizedImageUrl
+}
+
+// The configured widths below maxWidth, followed by maxWidth itself
 func generateWidths(maxWidth int) []int {
-	// Define a set of widths up to maxWidth
-	// Example: [320, 480, 640, 800, 960, 1280, 1600, maxWidth]
-	// Implement logic to generate this array based on maxWidth
-	return []int{320, 480, 640, 768, 1024, 1280, 1600, maxWidth}
+	widths := []int{}
+	for _, width := range config.Images.Widths {
+		if width < maxWidth {
+			widths = append(widths, width)
+		}
+	}
+	return append(widths, maxWidth)
 }
 
-// simple in-memory cache
-var optimizedImageCache = make(map[string]bool)
+// simple in-memory cache of the optimized images on disk
+var (
+	optimizedImageCacheMu sync.Mutex
+	optimizedImageCache   = make(map[string]bool)
+)
 
-func getSupportedImageFormat(headers http.Header) ImageFormat {
-	return FormatPNG
-	// acceptHeader := headers.Get("Accept")
-	// if strings.Contains(acceptHeader, "image/webp") {
-	// 	return FormatWebP
-	// } else {
-	// 	return FormatPNG // Default to PNG if no specific format is requested
-	// }
+// Whether the browser of an image request accepts webp
+func acceptsWebP(accept string) bool {
+	return config.Images.WebP && strings.Contains(accept, "image/webp")
 }
 
-func optimizeImage(url string, width int, format ImageFormat) (string, error) {
-	start := time.Now()
-	cacheKey := fmt.Sprintf("%s-%d", url, width)
-	imgPath := getOptimizedImagePath(url, width, format)
+func parseImageFormat(format string) (ImageFormat, bool) {
+	switch ImageFormat(format) {
+	case FormatWebP, FormatJPEG, FormatPNG:
+		return ImageFormat(format), true
+	case "jpg":
+		return FormatJPEG, true
+	}
+	return "", false
+}
 
-	// Check cache first
-	if _, exists := optimizedImageCache[cacheKey]; exists {
-		// fmt.Println("image already processed and in cache: ", imgPath)
+// Resizes the image at url and stores it in format, returning the file path.
+// Images with transparency requested as jpeg are stored as png instead.
+func optimizeImage(url string, width int, format ImageFormat, quality int) (string, error) {
+	quality = encodeQuality(quality)
+	if imgPath, found := cachedImage(url, width, format, quality); found {
 		return imgPath, nil
 	}
 
-	// not in cache yet, check if its in the file system before downloading it
-	if _, err := os.Stat(imgPath); err == nil {
-		// fmt.Println("image already processed: ", imgPath)
-		optimizedImageCache[cacheKey] = true // Update the cache
-		return imgPath, nil
+	srcImage, sourceFormat, err := downloadImage(url)
+	if err != nil {
+		return "", err
+	}
+	return encodeImage(srcImage, sourceFormat, url, width, format, quality)
+}
+
+// The quality lossy images are encoded with, the configured one by default
+func encodeQuality(quality int) int {
+	if quality < 1 || quality > 100 {
+		return config.Images.Quality
 	}
+	return quality
+}
 
-	// fmt.Println("image not processed yet: ", url)
+// Looks for an optimized image in the cache and on disk. A jpeg may have been
+// stored as png.
+func cachedImage(url string, width int, format ImageFormat, quality int) (string, bool) {
+	candidates := []string{getOptimizedImagePath(url, width, format, quality)}
+	if format == FormatJPEG {
+		candidates = append(candidates, getOptimizedImagePath(url, width, FormatPNG, quality))
+	}
 
-	// Download the image from the URL
+	for _, candidate := range candidates {
+		// Check cache first
+		optimizedImageCacheMu.Lock()
+		_, exists := optimizedImageCache[candidate]
+		optimizedImageCacheMu.Unlock()
+		if exists {
+			return candidate, true
+		}
+
+		// not in cache yet, check if its in the file system before downloading it
+		if _, err := os.Stat(candidate); err == nil {
+			optimizedImageCacheMu.Lock()
+			optimizedImageCache[candidate] = true // Update the cache
+			optimizedImageCacheMu.Unlock()
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// Downloads and decodes an image, returning its format like "jpeg" or "png"
+func downloadImage(url string) (image.Image, string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		fmt.Println("failed to download image: ", err)
-		return "", err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
-	// Decode the image
-	srcImage, _, err := image.Decode(resp.Body)
-
+	srcImage, sourceFormat, err := image.Decode(resp.Body)
 	if err != nil {
 		fmt.Println("failed to decode image: ", err)
-		return "", err
+		return nil, "", err
 	}
+	return srcImage, sourceFormat, nil
+}
 
-	// make sure the directory exists (without the filename)
-	err = os.MkdirAll(imgPath[:strings.LastIndex(imgPath, "/")], 0755)
-	if err != nil {
-		fmt.Println("failed to create directory: ", err)
-		return "", err
+// Resizes the image, encodes it in format and stores it. Graphics are
+// encoded to lossless webp, they'd get blurry edges otherwise.
+func encodeImage(srcImage image.Image, sourceFormat string, url string, width int, format ImageFormat, quality int) (string, error) {
+	start := time.Now()
+
+	resized := imaging.Resize(srcImage, width, 0, imaging.Lanczos)
+	if format == FormatJPEG && !resized.Opaque() {
+		format = FormatPNG
 	}
+	imgPath := getOptimizedImagePath(url, width, format, quality)
 
+	var buf bytes.Buffer
+	var err error
 	switch format {
 	case FormatWebP:
-		color.Red("FormatWebP not supported yet")
-
+		err = webp.Encode(&buf, resized, webp.Options{
+			Quality:  quality,
+			Lossless: sourceFormat == "png" || sourceFormat == "gif",
+			Method:   webp.DefaultMethod,
+		})
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: quality})
 	case FormatPNG:
-		dstImageFill := imaging.Resize(srcImage, width, 0, imaging.Lanczos)
-		err = imaging.Save(dstImageFill, imgPath)
-		if err != nil {
-			fmt.Println("failed to save image: ", err)
-			return "", err
-		}
+		err = png.Encode(&buf, resized)
+	default:
+		err = fmt.Errorf("unsupported image format %q", format)
+	}
+	if err != nil {
+		fmt.Println("failed to encode image: ", err)
+		return "", err
+	}
 
+	// concurrent requests for the same image must not see a partial file
+	if err := writeFileAtomic(imgPath, buf.Bytes()); err != nil {
+		fmt.Println("failed to save image: ", err)
+		return "", err
 	}
 
 	// Update the cache
-	optimizedImageCache[cacheKey] = true
+	optimizedImageCacheMu.Lock()
+	optimizedImageCache[imgPath] = true
+	optimizedImageCacheMu.Unlock()
 	// Log time duration
 	duration := time.Since(start)
 	fmt.Println("image processed: ", duration)
-	return getOptimizedImagePath(url, width, format), nil
+	return imgPath, nil
 }
 
-func getOptimizedImagePath(url string, width int, format ImageFormat) string {
+// Lossy images are stored per quality, .generated/images/<hash>/640w-q80.webp.
+// Whether a webp is lossless is only known once the source is downloaded.
+func getOptimizedImagePath(url string, width int, format ImageFormat, quality int) string {
 	safeImageName := convertURLToFilePath(url)
+	if format == FormatJPEG || format == FormatWebP {
+		return fmt.Sprintf(".generated/images/%s/%dw-q%d.%s", safeImageName, width, quality, format)
+	}
 	return fmt.Sprintf(".generated/images/%s/%dw.%s", safeImageName, width, format)
 }
 func convertURLToFilePath(url string) string {
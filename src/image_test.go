@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Serves a photo at /photo.jpg and a graphic at /logo.png
+func newImageServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 8), 128, 255})
+		}
+	}
+	var photo, graphic bytes.Buffer
+	jpeg.Encode(&photo, img, nil)
+	png.Encode(&graphic, img)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photo.jpg":
+			w.Write(photo.Bytes())
+		case "/logo.png":
+			w.Write(graphic.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Runs the test in a temporary directory, images are written to .generated
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestNegotiatedImageFormat(t *testing.T) {
+	inTempDir(t)
+	server := newImageServer(t)
+	width := config.Images.Widths[0]
+
+	// graphics are lossless webp (a VP8L chunk), photos lossy (VP8)
+	tests := []struct {
+		source string
+		accept string
+		want   string
+		chunk  string
+	}{
+		{"/photo.jpg", "image/avif,image/webp,*/*", "image/webp", "VP8 "},
+		{"/photo.jpg", "image/*", "image/jpeg", ""},
+		{"/logo.png", "image/avif,image/webp,*/*", "image/webp", "VP8L"},
+		{"/logo.png", "image/*", "image/jpeg", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, optimizedImageURL(server.URL+test.source, width, "", 0), nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		imageRouteHandler(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d: %s", test.source, test.accept, w.Code, w.Body)
+		}
+		if got := http.DetectContentType(w.Body.Bytes()); got != test.want {
+			t.Errorf("%s for %s = %s, want %s", test.source, test.accept, got, test.want)
+		}
+		if body := w.Body.Bytes(); test.chunk != "" && string(body[12:16]) != test.chunk {
+			t.Errorf("%s for %s is a %q webp, want %q", test.source, test.accept, body[12:16], test.chunk)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("Vary = %q, want Accept", vary)
+		}
+	}
+}
+
+func TestImageVariantsAreLimited(t *testing.T) {
+	inTempDir(t)
+	server := newImageServer(t)
+	source := url.QueryEscape(server.URL + "/photo.jpg")
+	width := config.Images.Widths[0]
+
+	for query, want := range map[string]int{
+		"width=" + strconv.Itoa(width):                  http.StatusOK,
+		"width=" + strconv.Itoa(width) + "&quality=60":  http.StatusOK,
+		"width=" + strconv.Itoa(width) + "&quality=61":  http.StatusBadRequest,
+		"width=" + strconv.Itoa(width) + "&quality=900": http.StatusBadRequest,
+		"width=" + strconv.Itoa(width) + "&quality=x":   http.StatusBadRequest,
+		"width=" + strconv.Itoa(width+1):                http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodGet, ImageBaseRoute+"/image.jpeg?url="+source+"&"+query, nil)
+		w := httptest.NewRecorder()
+		imageRouteHandler(w, r)
+
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", query, w.Code, want)
+		}
+	}
+
+	files, _ := filepath.Glob(".generated/images/*/*")
+	if len(files) != 2 {
+		t.Errorf("stored %v, want the default and the q60 variant", files)
+	}
+}
+
+func TestNormalizeQuality(t *testing.T) {
+	for quality, want := range map[int]int{
+		0:                     0,
+		config.Images.Quality: config.Images.Quality,
+		1:                     10,
+		64:                    60,
+		65:                    70,
+		100:                   100,
+	} {
+		if got := normalizeQuality(quality); got != want {
+			t.Errorf("normalizeQuality(%d) = %d, want %d", quality, got, want)
+		}
+	}
+}
+
+func TestImageProps(t *testing.T) {
+	attrs := string(getImageProps(false, "https://example.com/photo.jpg", "class=cover", "quality=60"))
+	if strings.Contains(attrs, "<") {
+		t.Errorf("imageProps returned an element: %s", attrs)
+	}
+	for _, want := range []string{`src="/_image/image?url=`, `&amp;quality=60"`, `class="cover"`, `srcset=`} {
+		if !strings.Contains(attrs, want) {
+			t.Errorf("imageProps %s is missing %s", attrs, want)
+		}
+	}
+
+	// pages in shared caches can't negotiate
+	if attrs := string(getImageProps(true, "https://example.com/photo.jpg")); !strings.Contains(attrs, `src="/_image/image.jpeg?`) {
+		t.Errorf("imageProps with a fixed format = %s", attrs)
+	}
+}
+
+func TestImageElement(t *testing.T) {
+	for _, source := range []string{"https://example.com/photo.jpg", "https://example.com/logo.png"} {
+		html := string(getImage(source, "alt=Image"))
+		if !strings.HasPrefix(html, `<picture><source type="image/webp" srcset="/_image/image.webp?`) ||
+			!strings.Contains(html, `<img src="/_image/image.jpeg?`) {
+			t.Errorf("%s = %s, want a <picture> with a webp source", source, html)
+		}
+	}
+
+	defer func(enabled bool) { config.Images.WebP = enabled }(config.Images.WebP)
+	config.Images.WebP = false
+	if html := string(getImage("https://example.com/photo.jpg")); !strings.HasPrefix(html, "<img ") || strings.Contains(html, "webp") {
+		t.Errorf("without webp = %s, want a jpeg <img>", html)
+	}
+}
+
+// webp is lossy for photos, so its quality is applied
+func TestWebPQuality(t *testing.T) {
+	inTempDir(t)
+	server := newImageServer(t)
+	width := config.Images.Widths[0]
+
+	sizes := map[int]int{}
+	for _, quality := range []int{10, 100} {
+		imgPath, err := optimizeImage(server.URL+"/photo.jpg", width, FormatWebP, quality)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(imgPath, "-q"+strconv.Itoa(quality)+".webp") {
+			t.Errorf("stored at %s", imgPath)
+		}
+		info, _ := os.Stat(imgPath)
+		sizes[quality] = int(info.Size())
+	}
+	if sizes[10] >= sizes[100] {
+		t.Errorf("quality 10 is %d bytes, quality 100 %d", sizes[10], sizes[100])
+	}
+}
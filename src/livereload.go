@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LiveReloadRoute = "/_livereload"
+
+// Events sent to the browsers:
+//   - css swaps the stylesheets without reloading the page, the data has their new urls
+//   - template refreshes the page body through htmx
+//   - reload reloads the whole page, e.g. when the js bundles changed
+//   - builderror shows a bundler error in the browser console
+type liveReloadEvent struct {
+	name string
+	data string
+}
+
+// liveReloadHub keeps the connected browsers in development and pushes file
+// changes to them over Server-Sent Events.
+type liveReloadHub struct {
+	mu      sync.Mutex
+	clients map[chan liveReloadEvent]bool
+}
+
+var liveReload = newLiveReloadHub()
+
+func newLiveReloadHub() *liveReloadHub {
+	return &liveReloadHub{
+		clients: make(map[chan liveReloadEvent]bool),
+	}
+}
+
+func liveReloadEnabled() bool {
+	return config.isDevelopment() && config.LiveReload
+}
+
+// broadcast sends an event to every connected browser. Browsers that can't
+// keep up miss the event rather than blocking the watcher.
+func (hub *liveReloadHub) broadcast(name string, data string) {
+	if !liveReloadEnabled() {
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for client := range hub.clients {
+		select {
+		case client <- liveReloadEvent{name: name, data: data}:
+		default:
+		}
+	}
+}
+
+func (hub *liveReloadHub) subscribe() chan liveReloadEvent {
+	client := make(chan liveReloadEvent, 8)
+	hub.mu.Lock()
+	hub.clients[client] = true
+	hub.mu.Unlock()
+	return client
+}
+
+func (hub *liveReloadHub) unsubscribe(client chan liveReloadEvent) {
+	hub.mu.Lock()
+	delete(hub.clients, client)
+	hub.mu.Unlock()
+}
+
+// Handles /_livereload, the event stream the injected client script listens to
+func liveReloadRouteHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || !liveReloadEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+
+	client := liveReload.subscribe()
+	defer liveReload.unsubscribe(client)
+
+	// reconnect quickly when the server restarts
+	fmt.Fprint(w, "retry: 500\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-client:
+			fmt.Fprintf(w, "event: %s\n", event.name)
+			for _, line := range strings.Split(event.data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// Where the generated assets are written, and the routes they are served from
+const (
+	bundleDir    = ".generated/esbuild/templates"
+	bundleRoute  = "/bundle/"
+	cssDir       = ".generated/css"
+	cssRoute     = "/css/"
+	manifestFile = ".generated/manifest.json"
+)
+
+// assetManifest maps the name of a built asset, like "contact.js" or
+// "main.css", to the url of its content hashed file, like
+// "/bundle/contact-5XKQ2MZB.js", and each bundle to the shared chunks it
+// imports. It's written to manifest.json after every build.
+type assetManifest struct {
+	mu      sync.RWMutex
+	files   map[string]string
+	imports map[string][]string
+}
+
+var manifest = &assetManifest{
+	files:   make(map[string]string),
+	imports: make(map[string][]string),
+}
+
+func (m *assetManifest) lookup(name string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	url, found := m.files[name]
+	return url, found
+}
+
+// The urls of the chunks a bundle imports, directly or through other chunks
+func (m *assetManifest) chunks(name string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.imports[name]
+}
+
+// replace swaps the assets served from route for the ones of a new build and
+// writes the manifest
+func (m *assetManifest) replace(route string, files map[string]string, imports map[string][]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, url := range m.files {
+		if strings.HasPrefix(url, route) {
+			delete(m.files, name)
+			delete(m.imports, name)
+		}
+	}
+	for name, url := range files {
+		m.files[name] = url
+	}
+	for name, chunks := range imports {
+		m.imports[name] = chunks
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"files":   m.files,
+		"imports": m.imports,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestFile, append(data, '\n'))
+}
+
+// The names of the files served from route, with the chunks they import
+func (m *assetManifest) filesIn(route string) map[string]bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make(map[string]bool)
+	for name, url := range m.files {
+		if !strings.HasPrefix(url, route) {
+			continue
+		}
+		names[strings.TrimPrefix(url, route)] = true
+		for _, chunk := range m.imports[name] {
+			names[strings.TrimPrefix(chunk, route)] = true
+		}
+	}
+	return names
+}
+
+// The built stylesheets as json, {"main.css": "/css/main-DMB2X6QA.css"},
+// sent with the css live reload event so browsers can swap them
+func (m *assetManifest) stylesheets() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := make(map[string]string)
+	for name, url := range m.files {
+		if strings.HasSuffix(name, ".css") {
+			files[name] = url
+		}
+	}
+	data, _ := json.Marshal(files)
+	return string(data)
+}
+
+// load reads the manifest of an earlier build, so a server started after
+// build-assets serves its assets even when it can't bundle them itself.
+// Assets whose files are gone are left out.
+func (m *assetManifest) load() error {
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	var saved struct {
+		Files   map[string]string   `json:"files"`
+		Imports map[string][]string `json:"imports"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", manifestFile, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, url := range saved.Files {
+		if _, err := os.Stat(assetPath(url)); err == nil {
+			m.files[name] = url
+		}
+	}
+	for name, chunks := range saved.Imports {
+		if _, found := m.files[name]; found {
+			m.imports[name] = chunks
+		}
+	}
+	return nil
+}
+
+// Loads the manifest of an earlier build, reports whether there was one
+func loadManifest() bool {
+	err := manifest.load()
+	if err != nil && !os.IsNotExist(err) {
+		serverLogger(color.RedString("Error loading the manifest: %s", err))
+	}
+	return err == nil
+}
+
+// Assets a page asked for that weren't built, each is only reported once
+var missingAssets sync.Map
+
+// The url of a built asset, for the asset template func. A missing asset is
+// logged and gives an empty url, so pages still render when a build failed.
+func assetURL(name string) string {
+	url, found := manifest.lookup(name)
+	if !found {
+		if _, reported := missingAssets.LoadOrStore(name, true); !reported {
+			serverLogger(color.RedString("asset %q is not in the manifest, did the build fail?", name))
+		}
+		return ""
+	}
+	missingAssets.Delete(name)
+	return url
+}
+
+// The esbuild metafile parts needed to map entry points to their output files
+type esbuildMetafile struct {
+	Outputs map[string]esbuildOutput `json:"outputs"`
+}
+
+type esbuildOutput struct {
+	EntryPoint string `json:"entryPoint"`
+	CSSBundle  string `json:"cssBundle"`
+	Imports    []struct {
+		Path string `json:"path"`
+		Kind string `json:"kind"`
+	} `json:"imports"`
+}
+
+// Maps the bundles of each entry point to their urls, the entry named contact
+// gives "contact.js" and, when it imports css, "contact.css". Shared code is
+// split into chunks, the chunks each entry imports are listed by its js name.
+func bundleManifest(metafile string) (map[string]string, map[string][]string, error) {
+	var meta esbuildMetafile
+	if err := json.Unmarshal([]byte(metafile), &meta); err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]string)
+	imports := make(map[string][]string)
+	for output, info := range meta.Outputs {
+		if info.EntryPoint == "" {
+			continue
+		}
+		name := entryName(output)
+		files[name+filepath.Ext(output)] = bundleRoute + filepath.Base(output)
+		if info.CSSBundle != "" {
+			files[name+".css"] = bundleRoute + filepath.Base(info.CSSBundle)
+		}
+		if chunks := staticImports(meta, output); len(chunks) > 0 {
+			imports[name+filepath.Ext(output)] = chunks
+		}
+	}
+	return files, imports, nil
+}
+
+// The entry name of an output file, contact-573TQTSE.js gives contact
+func entryName(output string) string {
+	name := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// The urls of the chunks an output needs before it runs, in the order they are
+// imported. Dynamic imports are left out, they load when they're used.
+func staticImports(meta esbuildMetafile, output string) []string {
+	chunks := []string{}
+	seen := map[string]bool{output: true}
+
+	var walk func(output string)
+	walk = func(output string) {
+		for _, imported := range meta.Outputs[output].Imports {
+			if imported.Kind != "import-statement" || seen[imported.Path] {
+				continue
+			}
+			seen[imported.Path] = true
+			chunks = append(chunks, bundleRoute+filepath.Base(imported.Path))
+			walk(imported.Path)
+		}
+	}
+	walk(output)
+
+	return chunks
+}
+
+// The file an asset url is served from
+func assetPath(url string) string {
+	if strings.HasPrefix(url, cssRoute) {
+		return filepath.Join(cssDir, strings.TrimPrefix(url, cssRoute))
+	}
+	return filepath.Join(bundleDir, strings.TrimPrefix(url, bundleRoute))
+}
+
+// Hashes file contents into 8 base32 characters, like the [hash] in esbuild's
+// file names. It's our own hash of the output, not the one esbuild computes.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base32.StdEncoding.EncodeToString(sum[:])[:8]
+}
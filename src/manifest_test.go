@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestLoad(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	os.MkdirAll(cssDir, 0o755)
+	os.MkdirAll(bundleDir, 0o755)
+	os.WriteFile(filepath.Join(cssDir, "main-AAAAAAAA.css"), nil, 0o644)
+	os.WriteFile(filepath.Join(bundleDir, "app-BBBBBBBB.js"), nil, 0o644)
+	os.WriteFile(manifestFile, []byte(`{
+		"files": {
+			"main.css": "/css/main-AAAAAAAA.css",
+			"app.js": "/bundle/app-BBBBBBBB.js",
+			"contact.js": "/bundle/contact-CCCCCCCC.js"
+		},
+		"imports": {
+			"app.js": ["/bundle/chunk-DDDDDDDD.js"],
+			"contact.js": ["/bundle/chunk-DDDDDDDD.js"]
+		}
+	}`), 0o644)
+
+	m := &assetManifest{files: make(map[string]string), imports: make(map[string][]string)}
+	if err := m.load(); err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := m.lookup("main.css"); url != "/css/main-AAAAAAAA.css" {
+		t.Errorf("main.css = %q", url)
+	}
+	if chunks := m.chunks("app.js"); len(chunks) != 1 {
+		t.Errorf("app.js chunks = %v", chunks)
+	}
+	// the file of an asset was removed since the manifest was written
+	if url, found := m.lookup("contact.js"); found {
+		t.Errorf("contact.js = %q, want it left out", url)
+	}
+	if chunks := m.chunks("contact.js"); chunks != nil {
+		t.Errorf("contact.js chunks = %v, want none", chunks)
+	}
+}
+
+func TestAssetURLOfMissingAsset(t *testing.T) {
+	if url := assetURL("missing.css"); url != "" {
+		t.Errorf("assetURL = %q, want an empty url", url)
+	}
+}
@@ -0,0 +1,97 @@
+-- Optional triggers that NOTIFY the Go server when pages or blocks change, so
+-- cached pages are invalidated in real time without Directus webhooks.
+--
+-- Run it with psql, or set DB_NOTIFY_MIGRATE=true to have the server install it
+-- on startup. The channel defaults to cookie_cache, the server passes its
+-- DB_NOTIFY_CHANNEL through the cookie.notify_channel setting.
+--
+-- Besides page, page_blocks and the block_* collections, every collection in
+-- directus_relations gets a trigger, so changes to related items (files,
+-- junction rows, cards etc.) invalidate the blocks they're expanded into.
+-- Rows added to an O2M or M2M relation invalidate the item they belong to.
+-- System collections are skipped, except directus_files.
+--
+-- Re-run it after adding new block_* collections or relations so they get a
+-- trigger too.
+
+CREATE OR REPLACE FUNCTION cookie_notify_change() RETURNS trigger AS $$
+DECLARE
+  rec jsonb;
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    rec := to_jsonb(OLD);
+  ELSE
+    rec := to_jsonb(NEW);
+  END IF;
+
+  PERFORM pg_notify(
+    TG_ARGV[0],
+    json_build_object(
+      'table', TG_TABLE_NAME,
+      'op', lower(TG_OP),
+      'id', rec ->> coalesce(TG_ARGV[1], 'id'),
+      'page_id', rec ->> 'page_id',
+      -- the foreign keys of O2M and M2M relations, an inserted row isn't
+      -- cached yet but the item it was added to is
+      'parents', (SELECT jsonb_object_agg(field, rec ->> field) FROM unnest(TG_ARGV[2:]) field)
+    )::text
+  );
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+DECLARE
+  channel text := coalesce(nullif(current_setting('cookie.notify_channel', true), ''), 'cookie_cache');
+  related text[] := '{}';
+  tbl text;
+  pk text;
+  parents text[];
+  args text;
+BEGIN
+  IF to_regclass('directus_relations') IS NOT NULL THEN
+    SELECT coalesce(array_agg(DISTINCT collection), '{}') INTO related
+    FROM (
+      SELECT many_collection AS collection FROM directus_relations
+      UNION
+      SELECT one_collection FROM directus_relations WHERE one_collection IS NOT NULL
+    ) collections;
+  END IF;
+
+  FOR tbl IN
+    SELECT table_name FROM information_schema.tables
+    WHERE table_schema = current_schema()
+      AND table_type = 'BASE TABLE'
+      AND (
+        table_name IN ('page', 'page_blocks', 'directus_files')
+        OR table_name LIKE 'block\_%'
+        OR (table_name::text = ANY(related) AND table_name NOT LIKE 'directus\_%')
+      )
+  LOOP
+    -- the key sent in the notification, the primary key is id unless the
+    -- collection was created with another one
+    SELECT a.attname INTO pk
+    FROM pg_index i
+    JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+    WHERE i.indrelid = format('%I', tbl)::regclass AND i.indisprimary
+    LIMIT 1;
+
+    parents := '{}';
+    IF to_regclass('directus_relations') IS NOT NULL THEN
+      SELECT coalesce(array_agg(DISTINCT many_field), '{}') INTO parents
+      FROM directus_relations
+      WHERE many_collection = tbl AND one_field IS NOT NULL;
+    END IF;
+
+    SELECT string_agg(quote_literal(arg), ', ') INTO args
+    FROM unnest(ARRAY[channel, coalesce(pk, 'id')] || parents) arg;
+
+    EXECUTE format('DROP TRIGGER IF EXISTS cookie_notify_change ON %I', tbl);
+    EXECUTE format(
+      'CREATE TRIGGER cookie_notify_change AFTER INSERT OR UPDATE OR DELETE ON %I '
+      'FOR EACH ROW EXECUTE PROCEDURE cookie_notify_change(%s)',
+      tbl, args
+    );
+  END LOOP;
+END;
+$$;
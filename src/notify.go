@@ -0,0 +1,104 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/lib/pq"
+)
+
+//go:embed migrations/cache_notify.sql
+var cacheNotifyMigration string
+
+// Payload sent by the triggers in migrations/cache_notify.sql
+type tableNotification struct {
+	Table  string `json:"table"`
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	PageID string `json:"page_id"`
+
+	// foreign keys of the O2M and M2M relations the row belongs to, by field
+	Parents map[string]string `json:"parents"`
+}
+
+// Installs the triggers that notify the channel when pages, blocks or the
+// items related to them change
+func installNotifyTriggers(channel string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// scoped to the transaction, read by the migration
+	if _, err := tx.Exec("SELECT set_config('cookie.notify_channel', $1, true)", channel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(cacheNotifyMigration); err != nil {
+		return fmt.Errorf("installing notify triggers: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Opens a dedicated connection that listens on the channel and evicts cached
+// pages as soon as the rows they were built from change
+func listenForChanges(channel string) error {
+	listener := pq.NewListener(config.Database.dsn(), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			serverLogger(color.RedString("db listener: %v", err))
+		}
+		// notifications sent while disconnected are lost, start over
+		if event == pq.ListenerEventReconnected {
+			pageCache.purge()
+		}
+	})
+
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return err
+	}
+	serverLogger("listening for cache invalidations on " + channel)
+
+	go func() {
+		for {
+			select {
+			case notification := <-listener.Notify:
+				// nil is sent after the connection was re-established
+				if notification != nil {
+					handleTableNotification(notification.Extra)
+				}
+			case <-time.After(90 * time.Second):
+				// make sure the connection is still alive
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func handleTableNotification(payload string) {
+	var notification tableNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		serverLogger(color.RedString("invalid notification %q: %v", payload, err))
+		return
+	}
+
+	event := DirectusEvent{
+		Event:      "db." + notification.Op,
+		Collection: notification.Table,
+		Key:        notification.ID,
+	}
+	event.Payload = make(map[string]interface{})
+	for field, key := range notification.Parents {
+		event.Payload[field] = key
+	}
+	if notification.PageID != "" {
+		event.Payload["page_id"] = notification.PageID
+	}
+
+	invalidateDirectusEvent(event)
+}
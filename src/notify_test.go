@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Installs the notify triggers in a scratch schema of the database at
+// TEST_DATABASE_URL and checks what the changes to it send, e.g.
+//
+//	TEST_DATABASE_URL=postgres://postgres@localhost/postgres?sslmode=disable go test ./src -run Notify
+func TestNotifyTriggers(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("set TEST_DATABASE_URL to run the notify triggers against Postgres")
+	}
+
+	conn, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single connection, so the search path applies to every statement
+	conn.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("cookie_notify_test_%d", os.Getpid())
+	t.Cleanup(func() {
+		conn.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE")
+		conn.Close()
+	})
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := conn.Exec(query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	exec("CREATE SCHEMA " + schema)
+	exec("SET search_path TO " + schema)
+	exec(`CREATE TABLE page (id serial PRIMARY KEY, uri text, status text, title text, template text)`)
+	exec(`CREATE TABLE page_blocks (id serial PRIMARY KEY, collection text, item text, page_id int, sort int)`)
+	exec(`CREATE TABLE block_hero (id serial PRIMARY KEY, headline text, image uuid, user_created uuid)`)
+	exec(`CREATE TABLE block_cards (id serial PRIMARY KEY)`)
+	exec(`CREATE TABLE card (code text PRIMARY KEY, title text)`)
+	exec(`CREATE TABLE block_cards_card (id serial PRIMARY KEY, block_cards_id int, card_code text)`)
+	exec(`CREATE TABLE directus_files (id uuid PRIMARY KEY, title text)`)
+	exec(`CREATE TABLE directus_users (id uuid PRIMARY KEY, password text)`)
+	exec(`CREATE TABLE directus_relations (many_collection text, many_field text, one_collection text, one_field text, junction_field text, sort_field text)`)
+	exec(`INSERT INTO directus_relations VALUES
+		('block_hero', 'image', 'directus_files', NULL, NULL, NULL),
+		('block_hero', 'user_created', 'directus_users', NULL, NULL, NULL),
+		('block_cards_card', 'block_cards_id', 'block_cards', 'cards', 'card_code', NULL),
+		('block_cards_card', 'card_code', 'card', NULL, 'block_cards_id', NULL)`)
+
+	const file = "6f1b7c9e-2d4a-4b8e-9c3f-0a1b2c3d4e5f"
+	exec(`INSERT INTO directus_files VALUES ($1, 'Hero')`, file)
+	exec(`INSERT INTO directus_users VALUES ($1, 'hash')`, file)
+	exec(`INSERT INTO card VALUES ('intro', 'Intro')`)
+	exec(`INSERT INTO block_cards DEFAULT VALUES`)
+
+	defer func(previous *sqlx.DB) { db = previous }(db)
+	db = conn
+	if err := installNotifyTriggers(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	listener := pq.NewListener(dsn, time.Second, time.Minute, nil)
+	defer listener.Close()
+	if err := listener.Listen(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	exec(`INSERT INTO page (uri, status, title) VALUES ('about', 'published', 'About')`)
+	exec(`INSERT INTO page_blocks (collection, item, page_id, sort) VALUES ('block_hero', '1', 1, 1)`)
+	exec(`UPDATE directus_files SET title = 'Sunset'`)
+	exec(`UPDATE directus_users SET password = 'new hash'`) // system collections don't notify
+	exec(`INSERT INTO block_cards_card (block_cards_id, card_code) VALUES (1, 'intro')`)
+	exec(`UPDATE card SET title = 'Welcome'`)
+	exec(`SELECT pg_notify($1, '{"table": "done"}')`, schema)
+
+	want := []tableNotification{
+		{Table: "page", Op: "insert", ID: "1"},
+		{Table: "page_blocks", Op: "insert", ID: "1", PageID: "1"},
+		{Table: "directus_files", Op: "update", ID: file},
+		{Table: "block_cards_card", Op: "insert", ID: "1", Parents: map[string]string{"block_cards_id": "1"}},
+		{Table: "card", Op: "update", ID: "intro"},
+	}
+	got := []tableNotification{}
+	for {
+		select {
+		case notification := <-listener.Notify:
+			var payload tableNotification
+			if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil {
+				t.Fatalf("invalid notification %q: %v", notification.Extra, err)
+			}
+			if payload.Table != "done" {
+				got = append(got, payload)
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for notifications")
+		}
+		break
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications = %+v\nwant %+v", got, want)
+	}
+
+	// a card added to a block invalidates the block it was added to
+	resetRelationsMetadata()
+	defer resetRelationsMetadata()
+	deps := parentDependencies(getRelationsMetadata(), "block_cards_card", map[string]interface{}{"block_cards_id": "1", "card_code": "intro"})
+	if !reflect.DeepEqual(deps, []string{"block_cards:1"}) {
+		t.Errorf("parent dependencies = %v, want [block_cards:1]", deps)
+	}
+}
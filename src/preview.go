@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PreviewRoute       = "/_preview"
+	previewCookieName  = "cookie_preview"
+	previewTokenMaxAge = time.Hour
+)
+
+// Statuses visible in preview mode
+var previewStatuses = []string{"published", "draft", "archived"}
+
+// A stored version of a Directus item, from directus_revisions
+type Revision struct {
+	Collection string
+	Item       string
+	Data       map[string]interface{}
+}
+
+// Handles /_preview?secret=...&uri=/some-page&revision=123. The secret must
+// match PREVIEW_SECRET, then a signed preview token is set as a cookie and the
+// browser is redirected to the page. For iframes that don't get the cookie (like
+// the Directus live preview) add token=true to carry the token in a ?preview=
+// query param instead.
+func previewRouteHandler(w http.ResponseWriter, r *http.Request) {
+	secret := config.PreviewSecret
+	if secret == "" {
+		notFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("secret")), []byte(secret)) != 1 {
+		http.Error(w, "Invalid preview secret", http.StatusUnauthorized)
+		return
+	}
+
+	uri := safeRedirectPath(query.Get("uri"))
+	expires := time.Now().Add(previewTokenMaxAge)
+	token := signPreviewToken(secret, expires)
+
+	http.SetCookie(w, previewCookie(r, token, expires))
+
+	redirect := url.Values{}
+	if revision := query.Get("revision"); revision != "" {
+		redirect.Set("revision", revision)
+	}
+	if query.Get("token") == "true" {
+		redirect.Set("preview", token)
+	}
+	if len(redirect) > 0 {
+		uri += "?" + redirect.Encode()
+	}
+
+	previewRedirect(w, r, uri)
+}
+
+// Handles /_preview/exit?uri=/some-page by clearing the preview cookie. htmx
+// requests without a uri reload the page they came from.
+func previewExitRouteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.SetCookie(w, previewCookie(r, "", time.Unix(0, 0)))
+
+	uri := r.URL.Query().Get("uri")
+	if uri == "" && getHtmxRequest(r).Request {
+		hxRefresh(w)
+		return
+	}
+	previewRedirect(w, r, safeRedirectPath(uri))
+}
+
+// htmx would follow a redirect and swap the page into the current one, it's
+// told to load the whole page instead so every part of it switches mode
+func previewRedirect(w http.ResponseWriter, r *http.Request, uri string) {
+	if getHtmxRequest(r).Request {
+		hxRedirect(w, uri)
+		return
+	}
+	http.Redirect(w, r, uri, http.StatusTemporaryRedirect)
+}
+
+func previewCookie(r *http.Request, token string, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     previewCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// allow the preview inside a cross site iframe when served over https
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	return cookie
+}
+
+// Only redirect to local paths
+func safeRedirectPath(uri string) string {
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.HasPrefix(uri, "/\\") {
+		return "/"
+	}
+	return uri
+}
+
+// Reports whether the request carries a valid preview token, and the revision to show
+func previewFromRequest(r *http.Request) (bool, int) {
+	secret := config.PreviewSecret
+	if secret == "" {
+		return false, 0
+	}
+
+	token := r.URL.Query().Get("preview")
+	if token == "" {
+		if cookie, err := r.Cookie(previewCookieName); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" || !verifyPreviewToken(secret, token) {
+		return false, 0
+	}
+
+	revision, _ := strconv.Atoi(r.URL.Query().Get("revision"))
+	return true, revision
+}
+
+// Tokens are "<expiry unix time>.<hex HMAC-SHA256 of the expiry>"
+func signPreviewToken(secret string, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + previewSignature(secret, payload)
+}
+
+func verifyPreviewToken(secret string, token string) bool {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(previewSignature(secret, payload)))
+}
+
+func previewSignature(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("preview:" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// applyRevision shows a stored revision of the page or one of its blocks.
+// Relations that were already expanded are kept, since revisions only store
+// the raw foreign keys.
+func applyRevision(page *Page, revision Revision) {
+	if revision.Collection == "page" && revision.Item == strconv.Itoa(page.ID) {
+		if title, ok := revision.Data["title"].(string); ok {
+			page.Title = title
+		}
+		if template, ok := revision.Data["template"].(string); ok {
+			page.Template = template
+		}
+		if status, ok := revision.Data["status"].(string); ok {
+			page.Status = status
+		}
+		return
+	}
+
+	for i, block := range page.Blocks {
+		if block.Collection != revision.Collection || block.Item != revision.Item {
+			continue
+		}
+
+		data := make(map[string]interface{}, len(block.Data))
+		for key, value := range block.Data {
+			data[key] = value
+		}
+		for key, value := range revision.Data {
+			switch data[key].(type) {
+			case map[string]interface{}, []interface{}:
+				continue
+			}
+			data[key] = value
+		}
+
+		page.Blocks[i].Data = data
+		page.Blocks[i].Lazy = isLazyBlock(data)
+	}
+}
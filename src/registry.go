@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+// templateRegistry parses the layout, components and page templates once and
+// hands out per-request clones. Parsed sets are keyed by page template name.
+type templateRegistry struct {
+	mu    sync.RWMutex
+	base  *template.Template
+	pages map[string]*template.Template
+}
+
+var templates = newTemplateRegistry()
+
+func newTemplateRegistry() *templateRegistry {
+	return &templateRegistry{
+		pages: make(map[string]*template.Template),
+	}
+}
+
+// get returns a fresh clone of the template set for the given page template,
+// with the request bound template functions attached.
+func (tr *templateRegistry) get(r *http.Request, templateName string) (*template.Template, error) {
+	tr.mu.RLock()
+	tmpl, found := tr.pages[templateName]
+	tr.mu.RUnlock()
+
+	if !found {
+		var err error
+		tmpl, err = tr.parsePage(templateName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the cached set is never executed, so it can always be cloned
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return clone.Funcs(templateFuncs(r, clone, templateName)), nil
+}
+
+// reset drops every parsed template so the next request re-reads them from disk.
+// Called by the watcher in development when templates or bundles change.
+func (tr *templateRegistry) reset() {
+	tr.mu.Lock()
+	tr.base = nil
+	tr.pages = make(map[string]*template.Template)
+	tr.mu.Unlock()
+}
+
+func (tr *templateRegistry) parsePage(templateName string) (*template.Template, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	// another request may have parsed it while we were waiting for the lock
+	if tmpl, found := tr.pages[templateName]; found {
+		return tmpl, nil
+	}
+
+	if tr.base == nil {
+		base, err := parseBaseTemplate()
+		if err != nil {
+			return nil, err
+		}
+		tr.base = base
+	}
+
+	tmpl, err := tr.base.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tmpl.Parse(autoloadTemplate(templateName)); err != nil {
+		return nil, err
+	}
+
+	if err := parseTemplateFile(tmpl, "src/templates/"+templateName+".go.html"); err != nil {
+		return nil, err
+	}
+
+	tr.pages[templateName] = tmpl
+	return tmpl, nil
+}
+
+// The file each template file was parsed from, keyed by its base name (the
+// name html/template gives it), so error overlays show the file that was used
+var templateFiles sync.Map
+
+func parseTemplateFile(tmpl *template.Template, path string) error {
+	// stored first, parse errors point at the file too
+	templateFiles.Store(filepath.Base(path), path)
+	_, err := tmpl.ParseFiles(path)
+	return err
+}
+
+// Parse the layout and every component once, shared by all page templates
+func parseBaseTemplate() (*template.Template, error) {
+	tmpl := template.New("layout.go.html").Funcs(templateFuncs(nil, nil, ""))
+	if err := parseTemplateFile(tmpl, "src/templates/layout.go.html"); err != nil {
+		return nil, err
+	}
+
+	// Add all templates in the components folder
+	err := appendTemplates(tmpl, "src/components", ".go.html")
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// The url of a directus_files image, from its id or the file itself when the
+// relation was expanded
+func directusImageURL(file interface{}) string {
+	id := fmt.Sprint(file)
+	if fileData, ok := file.(map[string]interface{}); ok {
+		id = fmt.Sprint(fileData["id"])
+	}
+	return config.Content.DirectusURL + "/assets/" + id
+}
+
+// Global template functions. Functions that depend on the request, the
+// template set or the page template (like how images are rendered) are bound
+// per request, r and tmpl are nil while parsing.
+func templateFuncs(r *http.Request, tmpl *template.Template, templateName string) template.FuncMap {
+	// a page in a shared cache is served to every browser, so its image urls
+	// can't leave the format to the Accept header of one of them
+	fixedFormat := exporting || cachePolicyFor(templateName).shared()
+
+	return template.FuncMap{
+		// Render HTML in a template without escaping it (or any other strings),
+		// a missing field renders nothing
+		"noescape": func(value interface{}) template.HTML {
+			if value == nil {
+				return ""
+			}
+			return template.HTML(fmt.Sprint(value))
+		},
+
+		// Whether to inject the live reload client, in development only
+		"liveReload": liveReloadEnabled,
+
+		// The content hashed url of a built asset, {{ asset "contact.js" }}
+		"asset": assetURL,
+
+		// The attributes of an optimized image, <img class="..." {{ imageProps "https://..." }} />
+		"imageProps": func(imageUrl string, otherParams ...string) template.HTMLAttr {
+			return getImageProps(fixedFormat, imageUrl, otherParams...)
+		},
+		// Accepts a directus_files id, or the file itself when the relation was expanded
+		"directusImageProps": func(file interface{}, otherParams ...string) template.HTMLAttr {
+			return getImageProps(fixedFormat, directusImageURL(file), otherParams...)
+		},
+
+		// A whole optimized image, a <picture> with a webp source that pages in
+		// shared caches can use too, {{ image "https://..." "class=object-cover" "alt=..." }}
+		"image": func(imageUrl string, otherParams ...string) template.HTML {
+			return getImage(imageUrl, otherParams...)
+		},
+		"directusImage": func(file interface{}, otherParams ...string) template.HTML {
+			return getImage(directusImageURL(file), otherParams...)
+		},
+
+		// Render a page block through the block registry
+		"renderBlock": func(block Block) (template.HTML, error) {
+			if tmpl == nil {
+				return "", errors.New("renderBlock called outside of a request")
+			}
+			return blockRegistry.renderBlock(r.Context(), tmpl, block, true)
+		},
+	}
+}
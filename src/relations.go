@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A row of directus_relations. M2O relations store the foreign key in
+// many_collection.many_field, the O2M side is the alias field one_field on
+// one_collection. M2M relations go through a junction collection whose
+// junction_field points at the other side.
+type Relation struct {
+	ManyCollection string         `db:"many_collection"`
+	ManyField      string         `db:"many_field"`
+	OneCollection  sql.NullString `db:"one_collection"`
+	OneField       sql.NullString `db:"one_field"`
+	JunctionField  sql.NullString `db:"junction_field"`
+	SortField      sql.NullString `db:"sort_field"`
+}
+
+type FieldMeta struct {
+	Collection string         `db:"collection"`
+	Field      string         `db:"field"`
+	Special    sql.NullString `db:"special"`
+}
+
+type PrimaryKeyMeta struct {
+	Collection string `db:"table_name"`
+	Field      string `db:"column_name"`
+}
+
+type relationsMetadata struct {
+	m2o         map[string][]Relation // many_collection -> relations with the foreign key on it
+	o2m         map[string][]Relation // one_collection -> relations with an alias field on it
+	junction    map[string]bool       // collection.field alias fields that are m2m or files
+	primaryKeys map[string]string     // collection -> primary key field, when it isn't id
+}
+
+// The primary key field of a collection
+func (m *relationsMetadata) primaryKey(collection string) string {
+	if field, ok := m.primaryKeys[collection]; ok {
+		return field
+	}
+	return "id"
+}
+
+// Directus system collections hold users, tokens and settings, only files are
+// expanded into block data
+func isExpandable(collection string) bool {
+	return !strings.HasPrefix(collection, "directus_") || collection == "directus_files"
+}
+
+var (
+	relationsMutex sync.Mutex
+	relations      *relationsMetadata
+)
+
+// Load the Directus relation metadata once. If the tables can't be read (e.g.
+// the database isn't a Directus one) relations are simply not expanded.
+func getRelationsMetadata() *relationsMetadata {
+	relationsMutex.Lock()
+	defer relationsMutex.Unlock()
+
+	if relations != nil {
+		return relations
+	}
+
+	relations = &relationsMetadata{
+		m2o:         make(map[string][]Relation),
+		o2m:         make(map[string][]Relation),
+		junction:    make(map[string]bool),
+		primaryKeys: make(map[string]string),
+	}
+
+	var rows []Relation
+	err := db.Select(&rows, "SELECT many_collection, many_field, one_collection, one_field, junction_field, sort_field FROM directus_relations")
+	if err != nil {
+		fmt.Println("Error querying directus_relations:", err)
+		return relations
+	}
+	for _, relation := range rows {
+		// M2A relations (like page_blocks.item) have no single one_collection
+		if !relation.OneCollection.Valid {
+			continue
+		}
+		relations.m2o[relation.ManyCollection] = append(relations.m2o[relation.ManyCollection], relation)
+		if relation.OneField.Valid {
+			relations.o2m[relation.OneCollection.String] = append(relations.o2m[relation.OneCollection.String], relation)
+		}
+	}
+
+	// directus_fields doesn't mark the primary key, Directus reads it from the schema too
+	var keys []PrimaryKeyMeta
+	err = db.Select(&keys, `SELECT tc.table_name, kcu.column_name FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu ON kcu.constraint_name = tc.constraint_name AND kcu.table_schema = tc.table_schema
+		WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = current_schema()`)
+	if err != nil {
+		fmt.Println("Error querying primary keys:", err)
+	}
+	for _, key := range keys {
+		relations.primaryKeys[key.Collection] = key.Field
+	}
+
+	var fields []FieldMeta
+	err = db.Select(&fields, "SELECT collection, field, special FROM directus_fields WHERE special IS NOT NULL")
+	if err != nil {
+		fmt.Println("Error querying directus_fields:", err)
+		return relations
+	}
+	for _, field := range fields {
+		for _, special := range strings.Split(field.Special.String, ",") {
+			if special == "m2m" || special == "files" {
+				relations.junction[field.Collection+"."+field.Field] = true
+			}
+		}
+	}
+
+	return relations
+}
+
+// Drop the cached relation metadata, e.g. after the Directus schema changed
+func resetRelationsMetadata() {
+	relationsMutex.Lock()
+	relations = nil
+	relationsMutex.Unlock()
+}
+
+// expandRelations replaces foreign keys and alias fields in the rows of a
+// collection with the related items, up to depth levels deep:
+//   - M2O and file fields become the related item, e.g. .image.title
+//   - O2M fields become a list of the related items
+//   - M2M and files fields become a list of the items on the other side of the junction
+//
+// It returns the dependency keys of every related item that was loaded.
+func expandRelations(ctx context.Context, collection string, rows []map[string]interface{}, depth int) ([]string, error) {
+	return expandRelationsExcept(ctx, collection, rows, depth, "")
+}
+
+// Same as expandRelations, but leaves the foreign key in exceptField alone.
+// Used for the items of an O2M relation so they don't expand back to their parent.
+func expandRelationsExcept(ctx context.Context, collection string, rows []map[string]interface{}, depth int, exceptField string) ([]string, error) {
+	if depth <= 0 || len(rows) == 0 {
+		return nil, nil
+	}
+
+	meta := getRelationsMetadata()
+	deps := []string{}
+
+	for _, relation := range meta.m2o[collection] {
+		if relation.ManyField == exceptField {
+			continue
+		}
+		relationDeps, err := expandManyToOne(ctx, meta, relation, rows, depth)
+		if err != nil {
+			return deps, err
+		}
+		deps = append(deps, relationDeps...)
+	}
+
+	for _, relation := range meta.o2m[collection] {
+		relationDeps, err := expandOneToMany(ctx, meta, collection, relation, rows, depth)
+		if err != nil {
+			return deps, err
+		}
+		deps = append(deps, relationDeps...)
+	}
+
+	return deps, nil
+}
+
+// The relation metadata of the active content source, from the Directus API
+// or the database. Nil when neither is available, e.g. the filesystem source.
+func contentRelationsMetadata(ctx context.Context) *relationsMetadata {
+	if source, ok := content.(*directusSource); ok {
+		return source.relationsMetadata(ctx)
+	}
+	if db == nil {
+		return nil
+	}
+	return getRelationsMetadata()
+}
+
+// The keys of the items a row of collection belongs to through an O2M or M2M
+// relation, read from the foreign keys in payload
+func parentDependencies(meta *relationsMetadata, collection string, payload map[string]interface{}) []string {
+	if meta == nil || len(payload) == 0 {
+		return nil
+	}
+
+	deps := []string{}
+	for _, relation := range meta.m2o[collection] {
+		if !relation.OneField.Valid {
+			continue
+		}
+		if key, ok := payload[relation.ManyField]; ok && key != nil {
+			deps = append(deps, dependencyKey(relation.OneCollection.String, key))
+		}
+	}
+	return deps
+}
+
+func expandManyToOne(ctx context.Context, meta *relationsMetadata, relation Relation, rows []map[string]interface{}, depth int) ([]string, error) {
+	target := relation.OneCollection.String
+	keys := collectKeys(rows, relation.ManyField)
+	if len(keys) == 0 || !isExpandable(target) {
+		return nil, nil
+	}
+
+	primaryKey := meta.primaryKey(target)
+	related, err := queryItems(ctx, target, primaryKey, keys, "")
+	if err != nil {
+		return nil, err
+	}
+
+	deps, err := expandRelations(ctx, target, related, depth-1)
+	if err != nil {
+		return deps, err
+	}
+
+	byID := make(map[string]map[string]interface{})
+	for _, item := range related {
+		id := fmt.Sprint(item[primaryKey])
+		byID[id] = item
+		deps = append(deps, dependencyKey(target, id))
+	}
+
+	for _, row := range rows {
+		if item, ok := byID[keyString(row[relation.ManyField])]; ok {
+			row[relation.ManyField] = item
+		}
+	}
+
+	return deps, nil
+}
+
+func expandOneToMany(ctx context.Context, meta *relationsMetadata, collection string, relation Relation, rows []map[string]interface{}, depth int) ([]string, error) {
+	alias := relation.OneField.String
+	primaryKey := meta.primaryKey(collection)
+	ids := collectKeys(rows, primaryKey)
+	if len(ids) == 0 || !isExpandable(relation.ManyCollection) {
+		return nil, nil
+	}
+
+	related, err := queryItems(ctx, relation.ManyCollection, relation.ManyField, ids, relation.SortField.String)
+	if err != nil {
+		return nil, err
+	}
+
+	deps := []string{}
+	for _, item := range related {
+		deps = append(deps, dependencyKey(relation.ManyCollection, item[meta.primaryKey(relation.ManyCollection)]))
+	}
+
+	// the junction rows are only a link, expand the other side and return that.
+	// The junction itself doesn't count as a level.
+	junctionField := relation.JunctionField.String
+	isJunction := meta.junction[collection+"."+alias] && junctionField != ""
+	relatedDepth := depth - 1
+	if isJunction {
+		relatedDepth = depth
+	}
+
+	relatedDeps, err := expandRelationsExcept(ctx, relation.ManyCollection, related, relatedDepth, relation.ManyField)
+	deps = append(deps, relatedDeps...)
+	if err != nil {
+		return deps, err
+	}
+
+	grouped := make(map[string][]interface{})
+	for _, item := range related {
+		parent := keyString(item[relation.ManyField])
+		if isJunction {
+			// not expanded when the depth ran out, keep the junction row
+			if target, ok := item[junctionField].(map[string]interface{}); ok {
+				grouped[parent] = append(grouped[parent], target)
+				continue
+			}
+		}
+		grouped[parent] = append(grouped[parent], item)
+	}
+
+	for _, row := range rows {
+		items := grouped[keyString(row[primaryKey])]
+		if items == nil {
+			items = []interface{}{}
+		}
+		row[alias] = items
+	}
+
+	return deps, nil
+}
+
+// Collect the distinct scalar values of a field, skipping empty and already expanded ones
+func collectKeys(rows []map[string]interface{}, field string) []string {
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, row := range rows {
+		key := keyString(row[field])
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func keyString(value interface{}) string {
+	switch v := value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return ""
+	case float64:
+		// numbers inside json columns
+		return fmt.Sprint(int64(v))
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cache-Control policy for rendered HTML pages, durations are in seconds
+type CachePolicy struct {
+	Private              bool `toml:"private" yaml:"private"`
+	NoStore              bool `toml:"no_store" yaml:"no_store"`
+	MaxAge               int  `toml:"max_age" yaml:"max_age"`
+	StaleWhileRevalidate int  `toml:"stale_while_revalidate" yaml:"stale_while_revalidate"`
+}
+
+func (p CachePolicy) String() string {
+	if p.NoStore {
+		return "no-store"
+	}
+
+	directives := []string{"public"}
+	if p.Private {
+		directives[0] = "private"
+	}
+	directives = append(directives, fmt.Sprintf("max-age=%d", p.MaxAge))
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", p.StaleWhileRevalidate))
+	}
+	return strings.Join(directives, ", ")
+}
+
+// Reports whether shared caches like CDNs may store the response
+func (p CachePolicy) shared() bool {
+	return !p.NoStore && !p.Private
+}
+
+// The defaults of config.HTTPCache
+func defaultHTTPCacheConfig() HTTPCacheConfig {
+	return HTTPCacheConfig{
+		Default: CachePolicy{Private: true, MaxAge: 60, StaleWhileRevalidate: 86400},
+		// Per template overrides of the default cache policy, keyed by template name,
+		// 404s stay out of shared caches so a page published later shows up at once
+		Templates: map[string]CachePolicy{
+			"404": {Private: true, MaxAge: 60},
+			"500": {NoStore: true},
+		},
+	}
+}
+
+// Returns the cache policy for a template, pages are never cached outside of production
+func cachePolicyFor(templateName string) CachePolicy {
+	if config.Env != "production" {
+		return CachePolicy{Private: true, MaxAge: 0}
+	}
+	if policy, ok := config.HTTPCache.Templates[templateName]; ok {
+		return policy
+	}
+	return config.HTTPCache.Default
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// don't hold on to unusually large pages
+	if buf.Cap() > 1<<20 {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// Strong ETag derived from the rendered content
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Strong ETag derived from the page identity, the time its data was cached and
+// the build version. Only usable in builds with a version, since a dev render
+// can change without the page data changing. The variant distinguishes
+// different renders of the same page (e.g. full page vs partial).
+func pageETag(pageData Page, templateName string, variant string) (string, bool) {
+	if version == "" || pageData.CachedAt.IsZero() {
+		return "", false
+	}
+
+	key := strings.Join([]string{
+		strconv.Itoa(pageData.ID),
+		strconv.FormatInt(pageData.CachedAt.UnixNano(), 10),
+		version,
+		templateName,
+		variant,
+	}, "|")
+	sum := sha256.Sum256([]byte(key))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, true
+}
+
+// Reports whether the If-None-Match request header matches the etag
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Responds with 304 Not Modified if the request has a matching validator
+func notModified(w http.ResponseWriter, r *http.Request, etag string, policy CachePolicy) bool {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !etagMatches(r, etag) {
+		return false
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", policy.String())
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Writes a fully rendered HTML page with its validators and cache policy
+func writeHTML(w http.ResponseWriter, r *http.Request, status int, body []byte, etag string, policy CachePolicy) {
+	if etag == "" {
+		etag = contentETag(body)
+	}
+
+	if status == http.StatusOK && notModified(w, r, etag, policy) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", policy.String())
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(status)
+
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
@@ -7,37 +7,42 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 )
 
-var assetMaxAge = 15552000
-
 func server() {
-	// if os.Getenv("APP_ENV") == "development" {
-	// 	assetMaxAge = 0
-	// }
+	err := initContentSource()
+	if err != nil {
+		log.Fatalf("Failed to initialize content source: %v", err)
+	}
+
+	pageCache = newPageCache(config.PageCache, loadPage)
 
-	err := initDB()
+	err = blockRegistry.discover()
 	if err != nil {
-		log.Fatalf("Failed to initialize database connection pool: %v", err)
+		log.Fatalf("Failed to discover block templates: %v", err)
 	}
 
+	assetMaxAge := int(config.Assets.MaxAge.Seconds())
 	mux := http.NewServeMux()
 
 	// HTTP Route Handler for all pages
 	mux.HandleFunc("/", routeHandler)
 
 	// HTTP Route Handler for generated CSS files
-	cssFileServer := http.FileServer(http.Dir(".generated/css"))
-	mux.Handle("/css/", maxAgeHandler(assetMaxAge, http.StripPrefix("/css/", cssFileServer)))
+	cssFileServer := http.FileServer(http.Dir(cssDir))
+	mux.Handle(cssRoute, http.StripPrefix(cssRoute, immutableHandler(cssDir, cssFileServer)))
 
-	// HTTP Route Handler for generated CSS files
-	esbuildFileServer := http.FileServer(http.Dir(".generated/esbuild/templates"))
-	mux.Handle("/bundle/", maxAgeHandler(assetMaxAge, http.StripPrefix("/bundle/", esbuildFileServer)))
+	// HTTP Route Handler for generated JS and CSS bundles
+	esbuildFileServer := http.FileServer(http.Dir(bundleDir))
+	mux.Handle(bundleRoute, http.StripPrefix(bundleRoute, immutableHandler(bundleDir, esbuildFileServer)))
 
 	// HTTP Route Handler for static files like favicon, robots etc
 	fileServer := http.FileServer(http.Dir("static")) // serves any file in /static directory
@@ -49,11 +54,26 @@ func server() {
 		http.ServeFile(w, r, "static/favicon.ico")
 	})
 
+	// HTTP Route Handler for lazy loaded blocks
+	mux.HandleFunc(BlockBaseRoute+"/", blockRouteHandler)
+
+	// HTTP Route Handler for Directus webhooks that invalidate the page cache
+	mux.HandleFunc(WebhookRoute, webhookRouteHandler)
+
+	// HTTP Route Handler for the live reload event stream, development only
+	if liveReloadEnabled() {
+		mux.HandleFunc(LiveReloadRoute, liveReloadRouteHandler)
+	}
+
+	// HTTP Route Handlers to enter and leave draft preview mode
+	mux.HandleFunc(PreviewRoute, previewRouteHandler)
+	mux.HandleFunc(PreviewRoute+"/exit", previewExitRouteHandler)
+
 	// Handler for image optimization
-	mux.Handle(ImageBaseRoute+"/", maxAgeHandler(15552000, http.HandlerFunc(imageRouteHandler)))
+	mux.Handle(ImageBaseRoute+"/", maxAgeHandler(int(config.Images.MaxAge.Seconds()), http.HandlerFunc(imageRouteHandler)))
 
 	httpServer := &http.Server{
-		Addr:    ":" + os.Getenv("PORT"),
+		Addr:    ":" + strconv.Itoa(config.Port),
 		Handler: mux,
 	}
 
@@ -75,6 +95,8 @@ func server() {
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait until the timeout deadline.
 	httpServer.Shutdown(ctx)
+	// stop the page loads still running in the background, like refreshes
+	cancelLoads()
 
 	log.Println("Server gracefully stopped")
 }
@@ -86,14 +108,81 @@ func maxAgeHandler(seconds int, h http.Handler) http.Handler {
 	})
 }
 
+// Content hashed files never change, a new build writes new names. Missing
+// files aren't marked, so a 404 isn't cached for good.
+func immutableHandler(dir string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fileExists(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func routeHandler(w http.ResponseWriter, r *http.Request) {
+	// previews skip the page cache, drafts must never be cached
+	if preview, revision := previewFromRequest(r); preview {
+		pageData, err := content.GetPreviewPage(r.Context(), r.URL.Path, revision)
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+		pageFound(pageData, w, r)
+		return
+	}
+
 	pageData, err := getPageData(r.URL.Path)
 	if err != nil {
 		notFound(w, r)
+		return
 	}
 	pageFound(pageData, w, r)
 }
 
+// Handles /_block/{page_id}/{block_id}
+func blockRouteHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, BlockBaseRoute+"/"), "/")
+	if len(parts) != 2 {
+		blockNotFound(w, r)
+		return
+	}
+
+	pageID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		blockNotFound(w, r)
+		return
+	}
+	blockID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		blockNotFound(w, r)
+		return
+	}
+
+	// the block was most likely just rendered as part of its page
+	if pageData, found := pageCache.findByID(pageID); found {
+		for _, block := range pageData.Blocks {
+			if block.ID == blockID {
+				blockFound(pageData, block, w, r)
+				return
+			}
+		}
+	}
+
+	block, err := content.GetBlock(r.Context(), pageID, blockID)
+	if err != nil {
+		blockNotFound(w, r)
+		return
+	}
+	// without the page, render it with the default template set
+	blockFound(Page{ID: pageID}, block, w, r)
+}
+
+// A missing lazy block leaves its skeleton loader in place, an error page
+// would replace the page around it
+func blockNotFound(w http.ResponseWriter, r *http.Request) {
+	writeHTML(w, r, http.StatusNotFound, nil, "", cachePolicyFor("404"))
+}
+
 func imageRouteHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Query().Get("url")
 	widthStr := r.URL.Query().Get("width")
@@ -112,9 +201,38 @@ func imageRouteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	format := getSupportedImageFormat(r.Header)
+	// only the widths and qualities pages ask for, so clients can't fill the
+	// disk with variants
+	if !isImageWidth(width) {
+		http.Error(w, "Invalid width", http.StatusBadRequest)
+		return
+	}
+	quality := 0
+	if qualityStr := r.URL.Query().Get("quality"); qualityStr != "" {
+		quality, err = strconv.Atoi(qualityStr)
+		if err != nil || quality < 1 || quality > 100 || normalizeQuality(quality) != quality {
+			http.Error(w, "Invalid quality", http.StatusBadRequest)
+			return
+		}
+	}
 
-	optimizedImagePath, err := optimizeImage(url, width, format)
+	// /_image/image.webp asks for a format, /_image/image leaves it to the Accept header
+	var optimizedImagePath string
+	format, ok := parseImageFormat(strings.TrimPrefix(path.Ext(r.URL.Path), "."))
+	switch {
+	case ok:
+		optimizedImagePath, err = optimizeImage(url, width, format, quality)
+	case path.Ext(r.URL.Path) != "":
+		http.Error(w, "Unsupported image format", http.StatusBadRequest)
+		return
+	default:
+		w.Header().Add("Vary", "Accept")
+		format = FormatJPEG
+		if acceptsWebP(r.Header.Get("Accept")) {
+			format = FormatWebP
+		}
+		optimizedImagePath, err = optimizeImage(url, width, format, quality)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -129,9 +247,9 @@ var version string
 func getVersionHash() string {
 	var versionHash string
 
-	if os.Getenv("APP_ENV") == "development" {
+	if config.Env == "development" {
 		versionHash = strconv.FormatInt(time.Now().UnixNano(), 10)
-	} else if os.Getenv("APP_ENV") == "production" {
+	} else if config.Env == "production" {
 		versionHash = version
 	}
 
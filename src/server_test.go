@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves the test content through the filesystem source, from the project
+// root like the server, with a fresh page cache and templates
+func serveTestContent(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	previousConfig, previousContent, previousCache := config, content, pageCache
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		config, content, pageCache = previousConfig, previousContent, previousCache
+		templates.reset()
+	})
+
+	config.Content.Source = "filesystem"
+	config.Content.Dir = dir
+	config.PreviewSecret = "s3cret"
+	if err := initContentSource(); err != nil {
+		t.Fatal(err)
+	}
+	pageCache = newPageCache(testPageCacheConfig(), loadPage)
+	templates.reset()
+	if err := blockRegistry.discover(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeFilesystemContent(t *testing.T) {
+	serveTestContent(t, "src/"+testContentDir)
+
+	for _, env := range []string{"production", "development"} {
+		config.Env = env
+		for uri, want := range map[string]string{
+			"/":            "Welcome <em>home</em>",
+			"/about":       "About us",
+			"/people":      "Team",
+			"/blog/draft":  "Page not found",
+			"/not-a-page":  "Page not found",
+			"/about/index": "Page not found",
+		} {
+			r := httptest.NewRequest(http.MethodGet, uri, nil)
+			w := httptest.NewRecorder()
+			routeHandler(w, r)
+
+			status := http.StatusOK
+			if strings.Contains(want, "not found") {
+				status = http.StatusNotFound
+			}
+			if w.Code != status || !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s %s: status %d, want %d with %q:\n%s", env, uri, w.Code, status, want, w.Body)
+			}
+			if cacheControl := w.Header().Get("Cache-Control"); status == http.StatusNotFound && !strings.Contains(cacheControl, "private") {
+				t.Errorf("%s %s: Cache-Control = %q, 404s must stay out of shared caches", env, uri, cacheControl)
+			}
+		}
+	}
+}
+
+func TestServeFilesystemLazyBlock(t *testing.T) {
+	serveTestContent(t, "src/"+testContentDir)
+
+	home, err := getPageData("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	routeHandler(w, r)
+	lazy := home.Blocks[1]
+	if !lazy.Lazy || !strings.Contains(w.Body.String(), `hx-get="`+BlockBaseRoute) {
+		t.Fatalf("the markdown block isn't lazy:\n%s", w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, BlockBaseRoute+"/"+strconv.Itoa(home.ID)+"/"+strconv.Itoa(lazy.ID), nil)
+	w = httptest.NewRecorder()
+	blockRouteHandler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<strong>bold</strong>") {
+		t.Errorf("block: status %d:\n%s", w.Code, w.Body)
+	}
+
+	// a missing block keeps its skeleton, htmx doesn't swap the 404
+	r = httptest.NewRequest(http.MethodGet, BlockBaseRoute+"/"+strconv.Itoa(home.ID)+"/999", nil)
+	r.Header.Set("HX-Request", "true")
+	w = httptest.NewRecorder()
+	blockRouteHandler(w, r)
+	if w.Code != http.StatusNotFound || w.Header().Get("HX-Retarget") != "" {
+		t.Errorf("missing block: status %d, HX-Retarget %q", w.Code, w.Header().Get("HX-Retarget"))
+	}
+}
+
+func TestServeFilesystemPreview(t *testing.T) {
+	serveTestContent(t, "src/"+testContentDir)
+
+	r := httptest.NewRequest(http.MethodGet, "/blog/draft", nil)
+	r.AddCookie(&http.Cookie{Name: previewCookieName, Value: signPreviewToken(config.PreviewSecret, time.Now().Add(time.Minute))})
+	w := httptest.NewRecorder()
+	routeHandler(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Not yet") {
+		t.Errorf("preview: status %d:\n%s", w.Code, w.Body)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("preview Cache-Control = %q, want no-store", cacheControl)
+	}
+}
+
+// The example content shipped in content/
+func TestServeExampleContent(t *testing.T) {
+	serveTestContent(t, "content")
+
+	for _, uri := range []string{"/", "/contact"} {
+		r := httptest.NewRequest(http.MethodGet, uri, nil)
+		w := httptest.NewRecorder()
+		routeHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d:\n%s", uri, w.Code, w.Body)
+		}
+	}
+}
+
+// Pages in shared caches can't negotiate the image format, their images name
+// the formats in a <picture>
+func TestServeImagesOnSharedPages(t *testing.T) {
+	serveTestContent(t, "src/"+testContentDir)
+	config.Env = "production"
+	config.HTTPCache.Default = CachePolicy{MaxAge: 60}
+
+	r := httptest.NewRequest(http.MethodGet, "/about", nil)
+	w := httptest.NewRecorder()
+	routeHandler(w, r)
+
+	body := w.Body.String()
+	for _, want := range []string{`<picture><source type="image/webp" srcset="/_image/image.webp?`, `<img src="/_image/image.jpeg?`, `alt="My hero image example"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/about is missing %s:\n%s", want, body)
+		}
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); strings.Contains(cacheControl, "private") {
+		t.Errorf("Cache-Control = %q, want a public page", cacheControl)
+	}
+}
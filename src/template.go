@@ -1,9 +1,7 @@
 package main
 
 import (
-	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,49 +13,78 @@ func pageFound(pageData Page, w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]interface {
 	}{
-		"Env":     os.Getenv("APP_ENV"),
+		"Env":     config.Env,
 		"Version": versionHash,
-		"Seo": Seo{
-			Title:       pageData.Title,
-			Description: "This is the SEO description",
-		},
-		"Data": pageData,
+		"Seo":     pageSeo(pageData),
+		"Data":    pageData,
 	}
 
 	templateName := getTemplateName(pageData.Template)
-
-	tmpl, err := bootstrapTemplate(r, pageData)
-	if err != nil {
-		log.Fatalf("Error bootstrapping template: %v", err)
+	policy := cachePolicyFor(templateName)
+	if pageData.Preview {
+		// drafts must not end up in shared caches, and lazy blocks would load the published version
+		policy = CachePolicy{NoStore: true}
+		data["Preview"] = true
+		data["Path"] = r.URL.Path
+		blocks := make([]Block, len(pageData.Blocks))
+		for i, block := range pageData.Blocks {
+			block.Lazy = false
+			blocks[i] = block
+		}
+		pageData.Blocks = blocks
+		data["Data"] = pageData
 	}
+	hx := getHtmxRequest(r)
+	setHtmxVary(w)
 
-	tmpl = template.Must(tmpl.ParseFiles("src/templates/" + templateName + ".go.html"))
+	// skip rendering entirely when the client already has this version of the page
+	etag, ok := pageETag(pageData, templateName, hx.variant())
+	if ok && notModified(w, r, etag, policy) {
+		return
+	}
 
-	tmpl, err = tmpl.Parse(blocksTemplateBuilder(pageData.Blocks))
+	tmpl, err := templates.get(r, templateName)
 	if err != nil {
-		log.Fatalf("Error parsing block templates: %v", err)
+		serverError(w, r, templateName, err)
+		return
 	}
 
-	if version == "production" {
-		w.Header().Add("Cache-Control", fmt.Sprintf("private, max-age=%d stale-while-revalidate=%d", 60, 86400))
+	// render into a buffer first so a failing template never sends half a page
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := tmpl.ExecuteTemplate(buf, hx.templateName(tmpl), data); err != nil {
+		serverError(w, r, templateName, err)
+		return
 	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-	if err := tmpl.Execute(w, data); err != nil {
-		log.Println("Error executing template:", err)
+	// only the blocks and custom elements on this page load their bundles
+	html := injectComponentAssets(buf.Bytes(), blockCollections(pageData.Blocks))
+
+	writeHTML(w, r, http.StatusOK, html, etag, policy)
+}
+
+func pageSeo(pageData Page) Seo {
+	seo := pageData.Seo
+	if seo.Title == "" {
+		seo.Title = pageData.Title
+	}
+	if seo.Description == "" {
+		seo.Description = "This is the SEO description"
 	}
+	return seo
 }
 
 func notFound(w http.ResponseWriter, r *http.Request) {
 	versionHash := getVersionHash()
 
-	tmpl, err := bootstrapTemplate(r, Page{})
+	tmpl, err := templates.get(r, "404")
 	if err != nil {
-		log.Fatalf("Error bootstrapping template: %v", err)
+		serverError(w, r, "404", err)
+		return
 	}
-	tmpl = template.Must(tmpl.ParseFiles("src/templates/404.go.html"))
 
 	data := map[string]interface{}{
+		"Env":     config.Env,
 		"Version": versionHash,
 		"Seo": Seo{
 			Title:       "404 - Page not found",
@@ -65,105 +92,92 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	// Set the Content-Type header
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	// Set the HTTP status code to 404
-	w.WriteHeader(http.StatusNotFound)
+	hx := getHtmxRequest(r).retargetError(w)
+	setHtmxVary(w)
 
-	if err := tmpl.Execute(w, data); err != nil {
-		log.Printf("Error executing 404 template: %v", err)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := tmpl.ExecuteTemplate(buf, hx.templateName(tmpl), data); err != nil {
+		serverError(w, r, "404", err)
 		return
 	}
-}
-
-// Bootstrap the template with some global functions and components
-func bootstrapTemplate(r *http.Request, pageData Page) (*template.Template, error) {
-	getImagePropsWithContext := func(imageUrl string, otherParams ...string) template.HTMLAttr {
-		return getImageProps(r.Header, imageUrl, otherParams...)
-	}
-
-	getImageByIdWithContext := func(id string, otherParams ...string) template.HTMLAttr {
-		imageUrl := os.Getenv("DIRECTUS_URL") + "/assets/" + id
-		return getImageProps(r.Header, imageUrl, otherParams...)
-	}
 
-	tmpl := template.Must(template.ParseFiles("src/templates/layout.go.html"))
-
-	tmpl.Funcs(template.FuncMap{
-		// Render HTML in a template without escaping it (or any other strings)
-		"noescape": func(str string) template.HTML {
-			return template.HTML(str)
-		},
-
-		"imageProps":         getImagePropsWithContext,
-		"directusImageProps": getImageByIdWithContext,
-	})
+	writeHTML(w, r, http.StatusNotFound, injectComponentAssets(buf.Bytes(), nil), "", cachePolicyFor("404"))
+}
 
-	templateName := getTemplateName(pageData.Template)
+// Build the autoload templates for the bundles generated for a page template.
+// The chunks the bundles import are preloaded, so the browser fetches them in
+// parallel instead of one import after the other.
+func autoloadTemplate(templateName string) string {
 	var autoLoadBodyStr string
 	var autoLoadHeadStr string
 
-	if fileExists(".generated/esbuild/templates/" + templateName + ".js") {
-		autoLoadBodyStr += `
-		<script defer src="/bundle/` + templateName + `.js?v={{.Version}}"></script>
+	// app.js is on every page, its chunks don't need loading again
+	preloaded := map[string]bool{}
+	if url, found := manifest.lookup("app.js"); found {
+		for _, chunk := range manifest.chunks("app.js") {
+			preloaded[chunk] = true
+			autoLoadHeadStr += `
+		<link rel="modulepreload" href="` + chunk + `" />
+		`
+		}
+		autoLoadHeadStr += `
+		<script type="module" src="` + url + `"></script>
 		`
 	}
-	if fileExists(".generated/esbuild/templates/" + templateName + ".css") {
+
+	// in the body too, so boosted navigation loads them as well
+	if url, found := manifest.lookup(templateName + ".js"); found {
+		for _, chunk := range manifest.chunks(templateName + ".js") {
+			if preloaded[chunk] {
+				continue
+			}
+			autoLoadBodyStr += `
+		<link rel="modulepreload" href="` + chunk + `" />
+		`
+		}
 		autoLoadBodyStr += `
-		<link rel="stylesheet" href="/bundle/` + templateName + `.css?v={{.Version}}" />
+		<script type="module" src="` + url + `"></script>
 		`
 	}
-	if fileExists(".generated/esbuild/templates/app.js") {
-		autoLoadHeadStr += `
-		<script defer src="/bundle/app.js?v={{.Version}}"></script>
+	if url, found := manifest.lookup(templateName + ".css"); found {
+		autoLoadBodyStr += `
+		<link rel="stylesheet" href="` + url + `" data-asset="` + templateName + `.css" />
 		`
 	}
 
-	tmpl.Parse(`
+	return `
 	{{ define "autoload_head" }}
 		` + autoLoadHeadStr + `
 	{{ end }}
-	`)
-	tmpl.Parse(`
 	{{ define "autoload_body_scripts" }}
 		` + autoLoadBodyStr + `
 	{{ end }}
-	`)
+	`
+}
 
-	// Add all templates in the components folder
-	err := appendTemplates(tmpl, "src/components", ".go.html")
+const BlockBaseRoute = "/_block"
+
+// Render a single block of a page, requested by lazy blocks once they are revealed
+func blockFound(pageData Page, block Block, w http.ResponseWriter, r *http.Request) {
+	templateName := getTemplateName(pageData.Template)
+
+	tmpl, err := templates.get(r, templateName)
 	if err != nil {
-		return nil, err
+		serverError(w, r, templateName, err)
+		return
 	}
 
-	return tmpl, nil
-}
-
-// Build the blocks template from the blocks in the page data
-func blocksTemplateBuilder(blocks []Block) string {
-	blockBuilderStr := `
-	{{ define "blocks" }}
-		{{ range .Data.Blocks }}
-			{{ if eq .Collection "a" }}
-				`
-
-	for _, block := range blocks {
-		// Check if template file exists
-		blockFileName := strings.Replace(block.Collection, "block_", "", 1)
-		if fileExists("src/components/blocks/" + blockFileName + ".go.html") {
-			blockBuilderStr += `
-					{{ else if eq .Collection "` + block.Collection + `" }}
-						{{ template "` + block.Collection + `" .Data }}
-					`
-		}
+	html, err := blockRegistry.renderBlock(r.Context(), tmpl, block, false)
+	if err != nil {
+		serverError(w, r, block.Collection, err)
+		return
 	}
 
-	blockBuilderStr += `
-			{{ end }}
-		{{ end }} 
-	{{ end }}
-	`
-	return blockBuilderStr
+	// a lazy block can bring custom elements the page didn't have yet
+	out := injectComponentAssets([]byte(html), []string{block.Collection})
+
+	writeHTML(w, r, http.StatusOK, out, "", cachePolicyFor(templateName))
 }
 
 func appendTemplates(tmpl *template.Template, rootDir, suffix string) error {
@@ -173,7 +187,7 @@ func appendTemplates(tmpl *template.Template, rootDir, suffix string) error {
 		}
 
 		if !info.IsDir() && strings.HasSuffix(path, suffix) {
-			_, err := tmpl.ParseFiles(path)
+			err := parseTemplateFile(tmpl, path)
 			if err != nil {
 				return err
 			}
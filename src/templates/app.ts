@@ -8,6 +8,16 @@ declare global {
 
 window.htmx = htmx;
 
+// htmx doesn't swap error responses, except the error pages the server
+// retargets to replace the whole page (HX-Retarget)
+document.addEventListener("htmx:beforeSwap", (event) => {
+  const detail = (event as CustomEvent).detail;
+  if (detail.xhr.status >= 400 && detail.xhr.getResponseHeader("HX-Retarget")) {
+    detail.shouldSwap = true;
+    detail.isError = false;
+  }
+});
+
 // import("htmx.org/dist/ext/preload")
 //   .then(() => {
 //     // Code from the imported script can be executed here
@@ -1,15 +1,5 @@
-import { registerComponents } from "@/core/register-components";
-import {
-  ExampleTimerComponent,
-  ExampleComponent,
-} from "@/custom-elements/example-component";
-import { MapboxComponent } from "@/custom-elements/mapbox";
-
-registerComponents({
-  "mapbox-component": MapboxComponent,
-  "example-component": ExampleComponent,
-  "example-timer": ExampleTimerComponent,
-});
+// <mapbox-component>, <example-component> and <example-timer> load their own
+// bundles from src/custom-elements when they're on the page
 
 document.querySelector("#my-test-form")?.addEventListener("submit", (event) => {
   event.preventDefault();
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 
 	"github.com/fatih/color"
 )
@@ -17,6 +16,34 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
+// Writes to a temporary file next to filename and renames it into place, so
+// readers see either the old or the new contents, never a half-written file
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
 func banner() {
 	str := `
   _____          __    _       _______             __
@@ -26,11 +53,13 @@ func banner() {
 `
 	c := color.New(color.FgCyan)
 	c.Println(str)
-	println(
-		color.HiCyanString(`	⚡️Cookie Go 1.0.0`) + "\n" +
-			`	- Server started at http://localhost:` + os.Getenv("PORT") + "\n" +
-			`	- BrowserSync proxy started at http://localhost:3000` + "\n" +
-			`	- Environment: ` + os.Getenv("APP_ENV") + "\n")
+	lines := color.HiCyanString(`	⚡️Cookie Go 1.0.0`) + "\n" +
+		`	- Server started at http://localhost:` + strconv.Itoa(config.Port) + "\n"
+	if liveReloadEnabled() {
+		lines += `	- Live reload enabled` + "\n"
+	}
+	lines += `	- Environment: ` + config.Env + "\n"
+	println(lines)
 }
 
 type LoggerConfig struct {
@@ -63,29 +92,9 @@ func serverLogger(str string) {
 	})
 }
 
-func startBrowserSync() {
-	filesToWatch := "src"
-
-	cmdArgs := []string{"start",
-		"--proxy", "localhost:" + os.Getenv("PORT"),
-		"--files",
-		filesToWatch,
-		"--plugins", "bs-html-injector?files[]=*.html",
-		"--no-notify",
-		"--no-open",
-		"--port", "3000",
-		"--ui-port", "3001",
-	}
-
-	cmd := exec.Command(
-		"./node_modules/.bin/browser-sync", cmdArgs...)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	cmdErr := cmd.Run()
-
-	if cmdErr != nil {
-		color.Red(fmt.Sprint(cmdErr) + ": " + stderr.String())
-		return
-	}
+func exportLogger(str string) {
+	logger(LoggerConfig{
+		prefix: color.BlueString("⚡️[export] "),
+		str:    color.HiWhiteString(str),
+	})
 }
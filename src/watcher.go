@@ -1,21 +1,54 @@
 package main
 
 import (
+	"fmt"
+	"io/fs"
 	"log"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-var globs = []string{
-	"src/**/*",
-	"src/**/**/*",
-}
+// Changes are collected until nothing happened for this long, so saving
+// several files at once (or an editor writing a file twice) rebuilds once
+const watchDebounce = 100 * time.Millisecond
+
+// Directories that are never watched
+var ignoredDirs = []string{"node_modules", ".generated", "tmp", "dist", "testdata"}
+
+// What needs rebuilding, changes of several kinds are combined into one rebuild
+type changeKind int
+
+const (
+	changeScripts   changeKind = 1 << iota // .ts, rebundled by esbuild
+	changeStyles                           // .css, rebuilt by postcss
+	changeTemplates                        // .html, the template cache is dropped
+	changeContent                          // .md pages of the filesystem content source
+)
 
-var exts = []string{
-	".html",
-	".css",
-	".ts",
+func changeKindOf(path string) changeKind {
+	switch filepath.Ext(path) {
+	case ".ts":
+		return changeScripts
+	case ".css":
+		if isComponentAsset(path) {
+			return changeStyles | changeScripts // bundled as its own entry
+		}
+		return changeStyles
+	case ".html":
+		return changeTemplates
+	case ".md":
+		// other content sources don't read Markdown files
+		if config.Content.Source == "filesystem" {
+			return changeContent
+		}
+	}
+	return 0
 }
 
 func watcher() {
@@ -26,41 +59,109 @@ func watcher() {
 	}
 	defer watcher.Close()
 
-	paths := []string{}
-	// get all file paths from globs
-	for _, glob := range globs {
-		filePaths, _ := filepath.Glob(glob)
-		paths = append(paths, filePaths...)
+	for _, dir := range watchedDirs() {
+		if err := watchRecursive(watcher, dir); err != nil && !os.IsNotExist(err) {
+			log.Println("error:", err)
+		}
 	}
-	// add all paths to watcher
-	for _, path := range paths {
-		watcher.Add(path)
+
+	rebuilds := newRebuilder()
+	go rebuilds.run()
+
+	watchForChanges(watcher, rebuilds)
+}
+
+// The directories to watch, the content directory only when pages are read from it
+func watchedDirs() []string {
+	dirs := []string{"src"}
+	if config.Content.Source == "filesystem" {
+		dirs = append(dirs, config.Content.Dir)
 	}
-	// Start listening for events.
-	go watchForChanges(watcher)
+	return dirs
+}
+
+// Watch a directory and everything below it. fsnotify only watches the
+// entries of a directory, so each sub directory is added as well.
+func watchRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && (strings.HasPrefix(d.Name(), ".") || slices.Contains(ignoredDirs, d.Name())) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
 
-	// Block main goroutine forever.
-	<-make(chan struct{})
+// The kinds of changes the files in a new directory make
+func changesIn(root string) changeKind {
+	var kind changeKind
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(d.Name(), ".") || slices.Contains(ignoredDirs, d.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		kind |= changeKindOf(path)
+		return nil
+	})
+	return kind
 }
 
-// watchForChanges handles file system events
-func watchForChanges(watcher *fsnotify.Watcher) {
+// watchForChanges coalesces file system events and queues a rebuild once they settle
+func watchForChanges(watcher *fsnotify.Watcher, rebuilds *rebuilder) {
 	watcherLogger("watching for file changes...")
+
+	var pending changeKind
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
-			if event.Op == fsnotify.Create {
-				// watcherLogger("created file: " + event.Name)
-				handleEvent(event, watcher)
+
+			// new directories, e.g. a new component folder, are watched too.
+			// Files moved or copied in with them send no events of their own.
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchRecursive(watcher, event.Name); err != nil {
+						log.Println("error:", err)
+					}
+					if kind := changesIn(event.Name); kind != 0 {
+						pending |= kind
+						debounce.Reset(watchDebounce)
+					}
+					continue
+				}
+			}
+
+			// removed and renamed files need a rebuild just like written ones
+			if event.Op == fsnotify.Chmod {
+				continue
 			}
 
-			if event.Op == fsnotify.Write {
-				// watcherLogger("updated file: " + event.Name)
-				handleEvent(event, watcher)
+			kind := changeKindOf(event.Name)
+			if kind == 0 {
+				continue
 			}
+			pending |= kind
+			debounce.Reset(watchDebounce)
+
+		case <-debounce.C:
+			rebuilds.queue(pending)
+			pending = 0
+
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
@@ -70,13 +171,104 @@ func watchForChanges(watcher *fsnotify.Watcher) {
 	}
 }
 
-func handleEvent(event fsnotify.Event, watcher *fsnotify.Watcher) {
-	fileExt := filepath.Ext(event.Name)
-	for _, ext := range exts {
-		if fileExt == ext {
-			watcher.Add(event.Name)
-			bundleAssets()
+// rebuilder runs one rebuild at a time. Changes queued while a rebuild is
+// running are merged into a single rebuild that starts right after it.
+type rebuilder struct {
+	mu      sync.Mutex
+	pending changeKind
+	wake    chan struct{}
+}
+
+func newRebuilder() *rebuilder {
+	return &rebuilder{wake: make(chan struct{}, 1)}
+}
+
+func (rb *rebuilder) queue(kind changeKind) {
+	rb.mu.Lock()
+	rb.pending |= kind
+	rb.mu.Unlock()
+
+	select {
+	case rb.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (rb *rebuilder) run() {
+	for range rb.wake {
+		rb.mu.Lock()
+		kind := rb.pending
+		rb.pending = 0
+		rb.mu.Unlock()
+
+		if kind != 0 {
+			rebuild(kind)
+		}
+	}
+}
+
+// rebuild only does the work the changed kinds of files need
+func rebuild(kind changeKind) {
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	start := time.Now()
+	steps := []string{}
+
+	if kind&changeContent != 0 {
+		if source, ok := content.(*fsSource); ok {
+			source.reset()
+		}
+		pageCache.purge()
+		steps = append(steps, "content")
+	}
+
+	if kind&changeTemplates != 0 {
+		// re-parse templates and block types on the next request
+		templates.reset()
+		if err := blockRegistry.discover(); err != nil {
+			log.Println("error:", err)
+		}
+		steps = append(steps, "templates")
+	}
+
+	// tailwind scans the templates for classes, so they rebuild the css too
+	cssChanged := kind&(changeStyles|changeTemplates) != 0
+	// a failed step already reported its error, the browsers keep the last good build
+	if cssChanged {
+		if err := buildStyles(); err != nil {
+			return
+		}
+		steps = append(steps, "styles")
+	}
+
+	scriptsChanged := kind&changeScripts != 0
+	if scriptsChanged {
+		if err := buildScripts(); err != nil {
 			return
 		}
+		// new bundles change which scripts the templates autoload
+		templates.reset()
+		steps = append(steps, "scripts")
+	}
+
+	if cssChanged || scriptsChanged {
+		if err := buildCSS(); err != nil {
+			return
+		}
+	}
+
+	watcherLogger(fmt.Sprintf("rebuilt %s in %0.2fms", strings.Join(steps, ", "), time.Since(start).Seconds()*1000))
+
+	switch {
+	case scriptsChanged:
+		liveReload.broadcast("reload", "")
+	case kind&(changeTemplates|changeContent) != 0:
+		if cssChanged {
+			liveReload.broadcast("css", manifest.stylesheets())
+		}
+		liveReload.broadcast("template", "")
+	case cssChanged:
+		liveReload.broadcast("css", manifest.stylesheets())
 	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// A folder moved into the watched tree only sends a create event for itself
+func TestChangesInNewDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"card/card.go.html",
+		"card/card.ts",
+		"card/notes.txt",
+		"card/node_modules/dep.css",
+		"card/.cache/old.md",
+		"card/README.md",
+	}
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := changesIn(filepath.Join(dir, "card")), changeTemplates|changeScripts; got != want {
+		t.Errorf("changesIn = %b, want %b", got, want)
+	}
+	if got := changesIn(filepath.Join(dir, "missing")); got != 0 {
+		t.Errorf("changesIn of a removed directory = %b, want 0", got)
+	}
+}
+
+// The content directory and Markdown files only matter to the filesystem source
+func TestWatchedContent(t *testing.T) {
+	defer func(c ContentConfig) { config.Content = c }(config.Content)
+	config.Content.Dir = "pages"
+
+	for source, watched := range map[string]bool{"postgres": false, "directus": false, "filesystem": true} {
+		config.Content.Source = source
+		if got := slices.Contains(watchedDirs(), "pages"); got != watched {
+			t.Errorf("%s: content directory watched = %v, want %v", source, got, watched)
+		}
+		if got := changeKindOf("pages/about.md") == changeContent; got != watched {
+			t.Errorf("%s: a Markdown change is a content change = %v, want %v", source, got, watched)
+		}
+	}
+}
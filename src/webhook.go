@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const WebhookRoute = "/_webhook/directus"
+
+// Payload sent by Directus webhooks and flows (event hook trigger with the
+// trigger data as the request body). Updates and deletes send keys, creates
+// send a single key.
+type DirectusEvent struct {
+	Event      string                 `json:"event"`
+	Collection string                 `json:"collection"`
+	Key        interface{}            `json:"key"`
+	Keys       []interface{}          `json:"keys"`
+	Payload    map[string]interface{} `json:"payload"`
+}
+
+// Handles Directus webhooks by evicting every cached page that uses the changed
+// items, then warming the cache again in the background. Requests must carry
+// the WEBHOOK_SECRET in an X-Webhook-Secret header, or an X-Webhook-Signature
+// header with the hex HMAC-SHA256 of the body signed with the secret.
+func webhookRouteHandler(w http.ResponseWriter, r *http.Request) {
+	secret := config.WebhookSecret
+	if secret == "" {
+		http.Error(w, "Webhooks are not configured", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyWebhook(r, body, secret) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var event DirectusEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.Collection == "" {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	invalidated := invalidateDirectusEvent(event)
+	serverLogger(fmt.Sprintf("webhook %s %s invalidated %d pages", event.Event, event.Collection, len(invalidated)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invalidated": invalidated,
+	})
+}
+
+func verifyWebhook(r *http.Request, body []byte, secret string) bool {
+	if signature := r.Header.Get("X-Webhook-Signature"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(strings.TrimPrefix(signature, "sha256=")), []byte(expected))
+	}
+
+	token := r.Header.Get("X-Webhook-Secret")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// Evicts the cached pages depending on the items in the event and refreshes them
+func invalidateDirectusEvent(event DirectusEvent) []string {
+	keys := event.Keys
+	if event.Key != nil {
+		keys = append(keys, event.Key)
+	}
+
+	deps := []string{}
+	for _, key := range keys {
+		deps = append(deps, dependencyKey(event.Collection, key))
+	}
+
+	switch event.Collection {
+	case "directus_relations", "directus_fields":
+		// the shape of the expanded block data changed, start over
+		resetRelationsMetadata()
+		if source, ok := content.(*directusSource); ok {
+			source.resetRelations()
+		}
+		pageCache.purge()
+		return []string{}
+
+	case "page":
+		// a new or published page may now exist at a url that was cached as not found
+		pageCache.invalidateNotFound()
+
+	case "page_blocks":
+		// blocks added to a page aren't known to the cache yet, so invalidate the page itself
+		if pageID, ok := event.Payload["page_id"]; ok && pageID != nil {
+			deps = append(deps, dependencyKey("page", pageID))
+		}
+	}
+
+	// items added to an O2M or M2M relation aren't known to the cache yet,
+	// so invalidate the item they were added to
+	deps = append(deps, parentDependencies(contentRelationsMetadata(context.Background()), event.Collection, event.Payload)...)
+
+	invalidated := pageCache.invalidate(deps...)
+	for _, key := range invalidated {
+		go pageCache.refresh(key)
+	}
+	return invalidated
+}
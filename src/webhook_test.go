@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(body string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookAuthentication(t *testing.T) {
+	defer func(secret string) { config.WebhookSecret = secret }(config.WebhookSecret)
+	config.WebhookSecret = "s3cret"
+
+	body := `{"event":"items.update","collection":"block_hero","keys":[1]}`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"no credentials", nil, http.StatusUnauthorized},
+		{"secret header", map[string]string{"X-Webhook-Secret": "s3cret"}, http.StatusOK},
+		{"wrong secret header", map[string]string{"X-Webhook-Secret": "guess"}, http.StatusUnauthorized},
+		{"signature", map[string]string{"X-Webhook-Signature": sign(body, "s3cret")}, http.StatusOK},
+		{"prefixed signature", map[string]string{"X-Webhook-Signature": "sha256=" + sign(body, "s3cret")}, http.StatusOK},
+		{"signature with another secret", map[string]string{"X-Webhook-Signature": sign(body, "guess")}, http.StatusUnauthorized},
+		{"signature of another body", map[string]string{"X-Webhook-Signature": sign(body+" ", "s3cret")}, http.StatusUnauthorized},
+		// a signature is checked on its own, a correct secret doesn't make up for a bad one
+		{"bad signature with secret header", map[string]string{"X-Webhook-Signature": "00", "X-Webhook-Secret": "s3cret"}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, WebhookRoute, strings.NewReader(body))
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			webhookRouteHandler(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestWebhookDisabledWithoutSecret(t *testing.T) {
+	defer func(secret string) { config.WebhookSecret = secret }(config.WebhookSecret)
+	config.WebhookSecret = ""
+
+	r := httptest.NewRequest(http.MethodPost, WebhookRoute, strings.NewReader(`{}`))
+	r.Header.Set("X-Webhook-Secret", "")
+	w := httptest.NewRecorder()
+	webhookRouteHandler(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestDependencyKeyOfDecodedIDs(t *testing.T) {
+	tests := []struct {
+		id   interface{}
+		want string
+	}{
+		{1000000, "page:1000000"},
+		{float64(1000000), "page:1000000"},
+		{float64(42), "page:42"},
+		{json.Number("1000000"), "page:1000000"},
+		{"1000000", "page:1000000"},
+		{"2f6c7a3e-uuid", "page:2f6c7a3e-uuid"},
+	}
+	for _, test := range tests {
+		if got := dependencyKey("page", test.id); got != test.want {
+			t.Errorf("dependencyKey(%#v) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}